@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditFormat         string
+	auditAdvisoryDB     string
+	auditFailOnSeverity string
+)
+
+// auditCmd checks the gems of an application against a local ruby-advisory-db
+var auditCmd = &cobra.Command{
+	Use:   "audit [filepath]",
+	Short: "Check the gems in Gemfile.lock against a local ruby-advisory-db checkout",
+	Long: `Check the gems in the Gemfile.lock of the application against a local checkout of
+ruby-advisory-db, without network access, printing the advisories with their CVE,
+severity and patched versions. With --fail-on-severity it exits with 8 when an
+advisory has that severity or higher, or no CVSS score.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vcrbpkg.Audit(cmd.Context(), args, auditFormat, auditAdvisoryDB, auditFailOnSeverity)
+	},
+	Example: "vcrbpkg audit /folder/to/app --advisory-db ~/ruby-advisory-db --fail-on-severity high",
+}
+
+func init() {
+	auditCmd.Flags().StringVar(
+		&auditFormat,
+		"format",
+		vcrbpkg.FormatText,
+		"Output format (text, json)")
+	auditCmd.Flags().StringVar(
+		&auditAdvisoryDB,
+		"advisory-db",
+		"",
+		"Local ruby-advisory-db checkout (git clone https://github.com/rubysec/ruby-advisory-db)")
+	auditCmd.Flags().StringVar(
+		&auditFailOnSeverity,
+		"fail-on-severity",
+		"",
+		"Exit with 8 for advisories of this severity or higher, or without a CVSS score: low, medium, high or critical")
+	_ = auditCmd.MarkFlagRequired("advisory-db")
+	rootCmd.AddCommand(auditCmd)
+}
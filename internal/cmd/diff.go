@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+var diffFormat string
+
+// diffCmd compares two packages produced by veracode prepare
+var diffCmd = &cobra.Command{
+	Use:   "diff [old.zip] [new.zip]",
+	Short: "Compare two packages produced by veracode prepare",
+	Long: `Compare two packages: files added, removed and changed, the number of compiled
+files and instruction sequences per source directory and the Ruby, Rails and
+Rails environment metadata. Exits with 4 when the packages differ materially,
+that is in more than the metadata files that change on every run.`,
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vcrbpkg.Diff(args, diffFormat)
+	},
+	Example: "vcrbpkg diff /tmp/veracode/app-v1.zip /tmp/veracode/app-v2.zip",
+}
+
+func init() {
+	diffCmd.Flags().StringVar(
+		&diffFormat,
+		"format",
+		vcrbpkg.FormatText,
+		"Output format (text, json)")
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+// doctorCmd checks the system build dependencies before packaging
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [filepath]",
+	Short: "Check if this system has everything needed to package a Rails application",
+	Long: `Check compilers, make, the libraries needed to build Ruby, OpenSSL, free disk space
+and the native libraries needed by gems in the Gemfile.lock of the application,
+printing the distribution packages to install for anything that is missing.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vcrbpkg.Doctor(args)
+	},
+	Example: "vcrbpkg doctor /folder/to/app",
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
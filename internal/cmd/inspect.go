@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+var inspectFormat string
+
+// inspectCmd shows what is in a package produced by veracode prepare
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [package.zip]",
+	Short: "Show what is in a package produced by veracode prepare",
+	Long: `Show the Ruby and Rails metadata of a package, the number of compiled instruction
+sequences per source directory, its size, the largest entries and any files that
+should not be in a package, like node_modules, logs or a .git directory.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vcrbpkg.Inspect(args, inspectFormat)
+	},
+	Example: "vcrbpkg inspect /tmp/veracode/railsgoat.zip --format json",
+}
+
+func init() {
+	inspectCmd.Flags().StringVar(
+		&inspectFormat,
+		"format",
+		vcrbpkg.FormatText,
+		"Output format (text, json)")
+	rootCmd.AddCommand(inspectCmd)
+}
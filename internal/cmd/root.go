@@ -22,23 +22,33 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
 	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "vcrbpkg [url or filepath]",
-	Short: "Package Ruby on Rails applications for Veracode Static Analysis",
-	Args:  cobra.MatchAll(cobra.OnlyValidArgs, validateURLorFilePath),
+	Use:     "vcrbpkg [url or filepath]",
+	Version: vcrbpkg.BuildVersion(),
+	Short:   "Package Ruby on Rails applications for Veracode Static Analysis",
+	Args:    cobra.MatchAll(cobra.OnlyValidArgs, validateURLorFilePath),
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		configureLogger()
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return vcrbpkg.Package(args, outFile)
+		return vcrbpkg.Package(cmd.Context(), args, configFile, flagOverrides(cmd))
 	},
 	Example: "vcrbpkg /folder/to/clone OR vcrbpkg https://github.com/user/repo",
 }
@@ -75,7 +85,7 @@ func main() {
 }
 
 var logLevel string
-var outFile string
+var configFile string
 
 func init() {
 	// Add a flag to set the log level
@@ -84,12 +94,166 @@ func init() {
 		"log-level",
 		"info",
 		"Set the log level (debug, info, warn, error, fatal, panic)")
+	// Add flag for the project configuration file.
+	rootCmd.Flags().StringVar(
+		&configFile,
+		"config",
+		"",
+		"Configuration file to use instead of .vcrbpkg.yml in the application (or set VCRBPKG_CONFIG)")
+
+	// Flags for options that can also be set in the configuration file or
+	// with VCRBPKG_* environment variables, see flagOverrides.
 	// Add flag for optional copying of output zip file.
-	rootCmd.PersistentFlags().StringVar(
-		&outFile,
+	rootCmd.Flags().String(
 		"out",
 		"",
-		"File to copy packaged application to (for example: /tmp/veracode/railsgoat.zip)")
+		"File, directory or template like {{.Repo}}-{{.Commit}}-{{.RailsEnv}}.zip to copy packaged application to, with a .sha256 checksum and .manifest.json next to it, or - to stream it to stdout (for example: /tmp/veracode/railsgoat.zip)")
+	rootCmd.Flags().Bool(
+		"force",
+		false,
+		"Overwrite the --out file if it already exists")
+	rootCmd.Flags().Bool(
+		"sbom",
+		true,
+		"Write a CycloneDX SBOM of the gems next to the --out file, like railsgoat.cdx.json")
+	// Add flag for signing the manifest of the exported package.
+	rootCmd.Flags().String(
+		"sign-key",
+		"",
+		"ed25519 private key in PEM or minisign secret key to sign the manifest of --out with (password in sign_password or VCRBPKG_SIGN_PASSWORD)")
+	// Add flag for failing when too little of the application is packaged.
+	rootCmd.Flags().Float64(
+		"min-coverage",
+		0,
+		"Fail with exit code 3 when less than this percentage of the .rb files in app/, lib/ and config/ is compiled into the package (for example: 90), also when the coverage is unknown")
+	// Add flags for validating the package.
+	rootCmd.Flags().String(
+		"validate",
+		vcrbpkg.ValidateFail,
+		"What to do with issues found in the package: off, warn, fail on errors or strict to also fail on warnings (exit code 5)")
+	rootCmd.Flags().String(
+		"max-package-size",
+		vcrbpkg.DefaultMaxPackageSize.String(),
+		"Largest package that passes validation")
+	// Add flags for scanning the package for secrets.
+	rootCmd.Flags().String(
+		"on-secret",
+		vcrbpkg.OnSecretWarn,
+		"What to do with secrets found in the package: off, warn, fail (exit code 6) or strip the entries with secrets (secrets in source files compiled into the package can not be stripped and still exit with 6)")
+	rootCmd.Flags().StringArray(
+		"secret-patterns",
+		nil,
+		"Regular expression for secrets besides the built-in rules, can be repeated")
+	// Add flags for checking the gems against ruby-advisory-db.
+	rootCmd.Flags().String(
+		"advisory-db",
+		"",
+		"Local ruby-advisory-db checkout to check the gems in Gemfile.lock against before packaging (for example: ~/ruby-advisory-db)")
+	rootCmd.Flags().String(
+		"fail-on-severity",
+		"",
+		"Fail with exit code 8 for advisories of this severity or higher, or without a CVSS score: low, medium, high or critical")
+	// Add flags for resolving secret:// references, these are not read from
+	// the .vcrbpkg.yml of the application.
+	rootCmd.Flags().String(
+		"secret-command",
+		"",
+		"Command to resolve secret://command/<reference> with, the reference is added as last argument (for example: \"pass show\")")
+	rootCmd.Flags().String(
+		"vault-addr",
+		"",
+		"Local Vault API for secret://vault/ references, only loopback addresses (default VAULT_ADDR or http://127.0.0.1:8200)")
+	// Add flag for writing a JSON report of the run.
+	rootCmd.Flags().String(
+		"report",
+		"",
+		"File to write a JSON report of the packaging run to (for example: /tmp/veracode/report.json)")
+	// Add flag for extending the known failures that are diagnosed.
+	rootCmd.Flags().String(
+		"known-failures",
+		"",
+		"JSON file with additional known failures to diagnose, in the format of known_failures.json")
+	// Add flags for installing the native libraries needed by gems.
+	rootCmd.Flags().Bool(
+		"install-system-deps",
+		false,
+		"Install missing native libraries needed by gems with apt-get, dnf, yum or apk (requires root or passwordless sudo)")
+	rootCmd.Flags().Bool(
+		"system-deps-dry-run",
+		false,
+		"Only list the system packages --install-system-deps would install")
+	// Add flag for the gem groups to exclude per environment.
+	rootCmd.Flags().StringArray(
+		"bundle-without",
+		nil,
+		"Gem groups to exclude for an environment as ENV=group1:group2, can be repeated (default production=development:test)")
+	// Add flags for choosing the Ruby version and Rails environment.
+	rootCmd.Flags().String(
+		"ruby-version",
+		"",
+		"Ruby version to use instead of the one from .ruby-version or the Gemfile (for example: 2.7.8)")
+	rootCmd.Flags().String(
+		"rails-env",
+		"",
+		"Rails environment to use for veracode prepare, skips testing which environment works")
+	rootCmd.Flags().StringSlice(
+		"envs",
+		[]string{"production", "development", "test"},
+		"Rails environments to try in order, including custom environments from config/environments")
+	// Add flag for sandboxing the application.
+	rootCmd.Flags().Bool(
+		"isolate-network",
+		false,
+		"Boot the application and run veracode prepare without network access, only loopback (Linux only)")
+	// Add flags for limiting the resources of the application, exceeding them
+	// fails the run with exit code 9.
+	rootCmd.Flags().Duration(
+		"step-timeout",
+		0,
+		"Maximum time for bundle install and veracode prepare in an environment (for example: 30m, default no limit)")
+	rootCmd.Flags().String(
+		"max-memory",
+		"",
+		"Maximum memory for bundle install, rails server and veracode prepare (for example: 4G, default no limit)")
+	rootCmd.Flags().Duration(
+		"max-cpu-time",
+		0,
+		"Maximum CPU time per process for bundle install, rails server and veracode prepare (for example: 20m, default no limit)")
+	rootCmd.Flags().Int(
+		"max-processes",
+		0,
+		"Maximum number of processes for bundle install, rails server and veracode prepare (default no limit)")
+	// Add flags for booting the application.
+	rootCmd.Flags().StringArray(
+		"env",
+		nil,
+		"Extra environment variable as KEY=VALUE for booting the application, can be repeated")
+	rootCmd.Flags().Bool(
+		"hermetic",
+		false,
+		"Only pass PATH, HOME, locale, proxy and RVM variables from the environment to bundle install, rails server and veracode prepare, besides --env and --pass-env")
+	rootCmd.Flags().StringSlice(
+		"pass-env",
+		nil,
+		"Extra environment variables to pass through with --hermetic, names can end with * (for example: BUNDLE_GITHUB__COM,AWS_*)")
+	rootCmd.Flags().Duration(
+		"boot-timeout",
+		15*time.Second,
+		"How long rails server needs to keep running for an environment to be considered working")
+}
+
+// flagOverrides returns the flags that were set on the command line, these take
+// precedence over the configuration file and environment variables.
+func flagOverrides(cmd *cobra.Command) vcrbpkg.Overrides {
+	overrides := vcrbpkg.Overrides{}
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		if sliceValue, ok := flag.Value.(pflag.SliceValue); ok {
+			overrides[flag.Name] = sliceValue.GetSlice()
+		} else {
+			overrides[flag.Name] = []string{flag.Value.String()}
+		}
+	})
+	return overrides
 }
 
 func configureLogger() {
@@ -103,10 +267,20 @@ func configureLogger() {
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	configureLogger()
+	// Stop running commands on Ctrl-C or SIGTERM, a second signal exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		logger.Warn("Interrupted, stopping running commands and cleaning up (interrupt again to exit immediately)")
+	}()
 
-	if err := rootCmd.Execute(); err != nil {
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		logger.Error(err)
+		var exitCoder interface{ ExitCode() int }
+		if errors.As(err, &exitCoder) {
+			os.Exit(exitCoder.ExitCode())
+		}
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+// sandboxCmd is run by vcrbpkg itself to set up the sandbox from inside
+// before executing the actual command, it is not meant to be used directly.
+var sandboxCmd = &cobra.Command{
+	Use:                vcrbpkg.SandboxCommand + " -- command [args]",
+	Hidden:             true,
+	DisableFlagParsing: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		vcrbpkg.SandboxExec(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sandboxCmd)
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sbomOut      string
+	sbomGemPaths []string
+	sbomForce    bool
+)
+
+// sbomCmd writes the SBOM of an application without packaging it
+var sbomCmd = &cobra.Command{
+	Use:   "sbom [filepath]",
+	Short: "Write a CycloneDX SBOM of the gems of a Rails application without packaging it",
+	Long: `Write a CycloneDX JSON SBOM of the gems in the Gemfile.lock of the application,
+with their package URLs, dependencies and git sources. Licenses and descriptions
+come from the gems installed in the veracode gemset, or the gem paths of the gem
+command when RVM is not available.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vcrbpkg.SBOM(cmd.Context(), args, sbomOut, sbomGemPaths, sbomForce)
+	},
+	Example: "vcrbpkg sbom /folder/to/app --out /tmp/veracode/railsgoat.cdx.json",
+}
+
+func init() {
+	sbomCmd.Flags().StringVar(
+		&sbomOut,
+		"out",
+		"",
+		"File to write the SBOM to (default stdout)")
+	sbomCmd.Flags().StringArrayVar(
+		&sbomGemPaths,
+		"gem-path",
+		nil,
+		"Directory with installed gems to read licenses from instead of the veracode gemset, can be repeated")
+	sbomCmd.Flags().BoolVar(
+		&sbomForce,
+		"force",
+		false,
+		"Overwrite the --out file if it already exists")
+	rootCmd.AddCommand(sbomCmd)
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	scanFormat         string
+	scanOnSecret       string
+	scanSecretPatterns []string
+)
+
+// scanCmd scans a package produced by veracode prepare for secrets
+var scanCmd = &cobra.Command{
+	Use:   "scan [package.zip]",
+	Short: "Scan a package produced by veracode prepare for secrets",
+	Long: `Scan the files in a package, and the source files compiled into it, for private
+keys, tokens, passwords and files like .env or config/master.key. With
+--on-secret=fail exits with 6 when secrets are found, with --on-secret=strip
+rewrites the package without the entries with secrets. Secrets in source files
+compiled into the package can not be stripped, so --on-secret=strip still exits
+with 6 for those.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vcrbpkg.Scan(args, scanFormat, scanOnSecret, scanSecretPatterns)
+	},
+	Example: "vcrbpkg scan /tmp/veracode/railsgoat.zip --on-secret fail",
+}
+
+func init() {
+	scanCmd.Flags().StringVar(
+		&scanFormat,
+		"format",
+		vcrbpkg.FormatText,
+		"Output format (text, json)")
+	scanCmd.Flags().StringVar(
+		&scanOnSecret,
+		"on-secret",
+		vcrbpkg.OnSecretWarn,
+		"What to do with secrets found: warn, fail or strip the entries with secrets (secrets in source files compiled into the package can not be stripped and still exit with 6)")
+	scanCmd.Flags().StringArrayVar(
+		&scanSecretPatterns,
+		"secret-patterns",
+		nil,
+		"Regular expression for secrets besides the built-in rules, can be repeated")
+	rootCmd.AddCommand(scanCmd)
+}
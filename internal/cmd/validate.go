@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	validateFormat         string
+	validateStrict         bool
+	validateMaxPackageSize string
+)
+
+// validateCmd checks a package produced by veracode prepare before uploading
+var validateCmd = &cobra.Command{
+	Use:   "validate [package.zip]",
+	Short: "Check a package produced by veracode prepare before uploading it",
+	Long: `Check that a package opens and is complete, has compiled code and metadata, is
+not larger than Veracode accepts and has no files that do not belong in a
+package, like node_modules, logs or a .git directory. Exits with 5 when there
+are errors, or also warnings with --strict.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		maxSize, err := vcrbpkg.ParseByteSize(validateMaxPackageSize)
+		if err != nil {
+			return err
+		}
+		return vcrbpkg.Validate(args, validateFormat, maxSize, validateStrict)
+	},
+	Example: "vcrbpkg validate /tmp/veracode/railsgoat.zip --strict",
+}
+
+func init() {
+	validateCmd.Flags().StringVar(
+		&validateFormat,
+		"format",
+		vcrbpkg.FormatText,
+		"Output format (text, json)")
+	validateCmd.Flags().BoolVar(
+		&validateStrict,
+		"strict",
+		false,
+		"Also fail on warnings, like files that do not belong in a package")
+	validateCmd.Flags().StringVar(
+		&validateMaxPackageSize,
+		"max-package-size",
+		vcrbpkg.DefaultMaxPackageSize.String(),
+		"Largest package that passes validation")
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyManifest  string
+	verifyPublicKey string
+)
+
+// verifyCmd checks an exported package against its manifest and signature
+var verifyCmd = &cobra.Command{
+	Use:   "verify [package.zip]",
+	Short: "Check an exported package against its manifest and signature",
+	Long: `Check the SHA-256 of a package exported with --out matches its manifest and,
+with --public-key, that the manifest is signed with that key. Exits with 7 when
+the package or signature does not match.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vcrbpkg.Verify(args, verifyManifest, verifyPublicKey)
+	},
+	Example: "vcrbpkg verify /tmp/veracode/railsgoat.zip --public-key minisign.pub",
+}
+
+func init() {
+	verifyCmd.Flags().StringVar(
+		&verifyManifest,
+		"manifest",
+		"",
+		"Manifest of the package (default <package>.manifest.json next to it)")
+	verifyCmd.Flags().StringVar(
+		&verifyPublicKey,
+		"public-key",
+		"",
+		"ed25519 public key in PEM, minisign public key file or minisign key (RW...) the manifest must be signed with")
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"io"
 	"os"
 
 	"github.com/sirupsen/logrus"
@@ -13,11 +14,26 @@ func init() {
 	logger.SetLevel(logrus.InfoLevel)
 }
 
+// SetOutput sets where the logger writes to, stdout by default
+func SetOutput(w io.Writer) {
+	logger.SetOutput(w)
+}
+
 // SetLevel sets the logging level for the logger
 func SetLevel(level logrus.Level) {
 	logger.SetLevel(level)
 }
 
+// Debug logs debug messages
+func Debug(args ...interface{}) {
+	logger.Debug(args...)
+}
+
+// Debugf logs formatted debug messages
+func Debugf(format string, args ...interface{}) {
+	logger.Debugf(format, args...)
+}
+
 // Info logs information messages
 func Info(args ...interface{}) {
 	logger.Info(args...)
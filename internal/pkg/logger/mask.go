@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const maskReplacement = "******"
+
+var (
+	masksMu sync.RWMutex
+	masks   []string
+)
+
+func init() {
+	logger.SetFormatter(maskingFormatter{logger.Formatter})
+}
+
+// AddMask makes value show up as ****** in all log output and in everything
+// passed through Mask, also when quoted or escaped as in JSON.
+func AddMask(value string) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+
+	forms := []string{value}
+	if quoted := strconv.Quote(value); quoted[1:len(quoted)-1] != value {
+		forms = append(forms, quoted[1:len(quoted)-1])
+	}
+	if encoded, err := json.Marshal(value); err == nil && string(encoded[1:len(encoded)-1]) != value {
+		forms = append(forms, string(encoded[1:len(encoded)-1]))
+	}
+
+	masksMu.Lock()
+	defer masksMu.Unlock()
+	masks = append(masks, forms...)
+	// Replace longer values first, in case one contains another
+	sort.Slice(masks, func(i, j int) bool { return len(masks[i]) > len(masks[j]) })
+}
+
+// Mask replaces the masked values in p.
+func Mask(p []byte) []byte {
+	masksMu.RLock()
+	defer masksMu.RUnlock()
+	for _, mask := range masks {
+		p = bytes.ReplaceAll(p, []byte(mask), []byte(maskReplacement))
+	}
+	return p
+}
+
+// maskingFormatter masks values in log entries formatted by Formatter.
+type maskingFormatter struct {
+	logrus.Formatter
+}
+
+func (f maskingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	formatted, err := f.Formatter.Format(entry)
+	return Mask(formatted), err
+}
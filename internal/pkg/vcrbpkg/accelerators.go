@@ -0,0 +1,85 @@
+package vcrbpkg
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// bootAccelerator is a gem that speeds up booting by preloading or caching,
+// which makes rails server and veracode prepare load stale code or fail to
+// write their cache in read-only checkouts.
+type bootAccelerator struct {
+	Gem string
+	// Env disables the gem.
+	Env map[string]string
+	// CacheDirs are variables set to a cache directory in the workspace, for
+	// versions that do not support being disabled.
+	CacheDirs []string
+}
+
+var bootAccelerators = []bootAccelerator{
+	{Gem: "spring", Env: map[string]string{"DISABLE_SPRING": "1"}},
+	{Gem: "bootsnap", Env: map[string]string{"DISABLE_BOOTSNAP": "1"}, CacheDirs: []string{"BOOTSNAP_CACHE_DIR"}},
+}
+
+// DisabledAccelerator is a boot accelerator that was disabled for the run.
+type DisabledAccelerator struct {
+	Gem     string   `json:"gem"`
+	Version string   `json:"version"`
+	Env     []string `json:"env"`
+}
+
+// disableBootAccelerators adds the variables that disable the boot
+// accelerators in the Gemfile.lock of the application to opts.Env, with cache
+// directories in workspace. Variables configured in env are left alone.
+func disableBootAccelerators(repoFolder string, workspace string, opts *Options, report *Report) {
+	lockfile, err := parseLockfile(repoFolder)
+	if err != nil {
+		logger.Debugf("Not checking for boot accelerators: %v", err)
+		return
+	}
+
+	env := map[string]string{}
+	for name, value := range opts.Env {
+		env[name] = value
+	}
+
+	for _, accelerator := range bootAccelerators {
+		gem, found := lockfile.Gem(accelerator.Gem)
+		if !found {
+			continue
+		}
+
+		disabled := DisabledAccelerator{Gem: gem.Name, Version: gem.Version}
+		set := func(name string, value string) {
+			if _, configured := env[name]; configured {
+				logger.Infof("Not setting %s for %s, it is configured in env", name, gem.Name)
+				return
+			}
+			env[name] = value
+			disabled.Env = append(disabled.Env, name+"="+value)
+		}
+		for name, value := range accelerator.Env {
+			set(name, value)
+		}
+		for _, name := range accelerator.CacheDirs {
+			cacheDir := filepath.Join(workspace, gem.Name)
+			if err := os.MkdirAll(cacheDir, 0755); err != nil {
+				logger.WithError(err).Warnf("Unable to create cache directory %s for %s", cacheDir, gem.Name)
+				continue
+			}
+			set(name, cacheDir)
+		}
+		if len(disabled.Env) == 0 {
+			continue
+		}
+		sort.Strings(disabled.Env)
+
+		logger.Infof("Disabling %s %s while packaging: %v", gem.Name, gem.Version, disabled.Env)
+		report.DisabledAccelerators = append(report.DisabledAccelerators, disabled)
+	}
+	opts.Env = env
+}
@@ -0,0 +1,377 @@
+package vcrbpkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// ExitVulnerableGems is the exit code when gems have advisories at or above
+// fail_on_severity.
+const ExitVulnerableGems = 8
+
+// Severities of advisories, from their CVSS score like bundler-audit.
+const (
+	SeverityUnknown  = "unknown"
+	SeverityNone     = "none"
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// severities are the severities fail_on_severity can be set to, lowest first.
+var severities = []string{SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical}
+
+// advisory is a gem advisory from ruby-advisory-db, gems/<gem>/<id>.yml.
+type advisory struct {
+	Gem                string   `yaml:"gem"`
+	CVE                string   `yaml:"cve"`
+	GHSA               string   `yaml:"ghsa"`
+	OSVDB              string   `yaml:"osvdb"`
+	URL                string   `yaml:"url"`
+	Title              string   `yaml:"title"`
+	Date               string   `yaml:"date"`
+	CVSSv2             float64  `yaml:"cvss_v2"`
+	CVSSv3             float64  `yaml:"cvss_v3"`
+	CVSSv4             float64  `yaml:"cvss_v4"`
+	PatchedVersions    []string `yaml:"patched_versions"`
+	UnaffectedVersions []string `yaml:"unaffected_versions"`
+	file               string
+}
+
+// id returns the CVE, GHSA or OSVDB ID of the advisory, or its file name.
+func (a *advisory) id() string {
+	switch {
+	case a.CVE != "":
+		return "CVE-" + a.CVE
+	case a.GHSA != "":
+		return "GHSA-" + a.GHSA
+	case a.OSVDB != "":
+		return "OSVDB-" + a.OSVDB
+	}
+	return strings.TrimSuffix(filepath.Base(a.file), filepath.Ext(a.file))
+}
+
+// severity returns the severity of the newest CVSS score of the advisory.
+func (a *advisory) severity() (string, float64) {
+	switch {
+	case a.CVSSv4 > 0:
+		return cvssSeverity(a.CVSSv4, true), a.CVSSv4
+	case a.CVSSv3 > 0:
+		return cvssSeverity(a.CVSSv3, true), a.CVSSv3
+	case a.CVSSv2 > 0:
+		return cvssSeverity(a.CVSSv2, false), a.CVSSv2
+	}
+	return SeverityUnknown, 0
+}
+
+// cvssSeverity returns the qualitative severity of a CVSS score, CVSS v2 has
+// no critical.
+func cvssSeverity(score float64, hasCritical bool) string {
+	switch {
+	case score >= 9 && hasCritical:
+		return SeverityCritical
+	case score >= 7:
+		return SeverityHigh
+	case score >= 4:
+		return SeverityMedium
+	case score > 0:
+		return SeverityLow
+	}
+	return SeverityNone
+}
+
+// severityRank returns the position of severity in severities, -1 for none
+// and unknown.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// affects returns whether version is neither patched nor unaffected.
+func (a *advisory) affects(version gemVersion) (bool, error) {
+	for _, requirement := range append(append([]string{}, a.PatchedVersions...), a.UnaffectedVersions...) {
+		matches, err := gemRequirementMatches(requirement, version)
+		if err != nil {
+			return false, err
+		}
+		if matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// GemAudit is the result of checking the gems in a Gemfile.lock against
+// ruby-advisory-db.
+type GemAudit struct {
+	Lockfile   string `json:"lockfile"`
+	AdvisoryDB string `json:"advisory_db"`
+	// AdvisoryDBCommit is the commit of the ruby-advisory-db checkout, if it
+	// is one.
+	AdvisoryDBCommit string          `json:"advisory_db_commit,omitempty"`
+	Gems             int             `json:"gems"`
+	Vulnerabilities  []Vulnerability `json:"vulnerabilities"`
+}
+
+// Vulnerability is an advisory that affects a locked gem.
+type Vulnerability struct {
+	Gem             string   `json:"gem"`
+	Version         string   `json:"version"`
+	ID              string   `json:"id"`
+	Title           string   `json:"title"`
+	URL             string   `json:"url,omitempty"`
+	Severity        string   `json:"severity"`
+	CVSS            float64  `json:"cvss,omitempty"`
+	PatchedVersions []string `json:"patched_versions"`
+}
+
+// VulnerableGemsError is returned when gems have advisories at or above the
+// severity to fail on.
+type VulnerableGemsError struct {
+	Vulnerabilities int
+	Severity        string
+}
+
+func (e *VulnerableGemsError) Error() string {
+	return fmt.Sprintf("found %d advisory(ies) for gems with severity %s or higher, or unknown", e.Vulnerabilities, e.Severity)
+}
+
+// ExitCode makes vcrbpkg exit with ExitVulnerableGems.
+func (e *VulnerableGemsError) ExitCode() int {
+	return ExitVulnerableGems
+}
+
+// checkAdvisoryDB returns an error when dir is not a ruby-advisory-db
+// checkout.
+func checkAdvisoryDB(dir string) error {
+	if stat, err := os.Stat(filepath.Join(dir, "gems")); err != nil || !stat.IsDir() {
+		return fmt.Errorf("%s is not a ruby-advisory-db checkout, gems/ not found (git clone https://github.com/rubysec/ruby-advisory-db)", dir)
+	}
+	return nil
+}
+
+// loadAdvisories reads the advisories for gem from the advisory database in
+// dir, no advisories is not an error.
+func loadAdvisories(dir string, gem string) ([]*advisory, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "gems", gem, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	var advisories []*advisory
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to read advisory %s", file)
+			return nil, fmt.Errorf("unable to read advisory %s", file)
+		}
+		advisory := &advisory{file: file}
+		if err := yaml.Unmarshal(content, advisory); err != nil {
+			logger.WithError(err).Warnf("Skipping invalid advisory %s", file)
+			continue
+		}
+		advisories = append(advisories, advisory)
+	}
+	return advisories, nil
+}
+
+// AuditLockfile checks the gems in the Gemfile.lock of repoFolder against the
+// ruby-advisory-db checkout in advisoryDB, without network access.
+func AuditLockfile(ctx context.Context, repoFolder string, advisoryDB string) (*GemAudit, error) {
+	if err := checkAdvisoryDB(advisoryDB); err != nil {
+		return nil, err
+	}
+	lockfile, err := parseLockfile(repoFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := &GemAudit{
+		Lockfile:         filepath.Join(repoFolder, "Gemfile.lock"),
+		AdvisoryDB:       advisoryDB,
+		AdvisoryDBCommit: gitCommit(ctx, advisoryDB),
+		Vulnerabilities:  []Vulnerability{},
+	}
+	// Gems locked for several platforms are checked once
+	checked := map[string]bool{}
+	for _, gem := range lockfile.Gems {
+		if checked[gem.Name+" "+gem.Version] {
+			continue
+		}
+		checked[gem.Name+" "+gem.Version] = true
+		audit.Gems++
+
+		version, err := parseGemVersion(gem.Version)
+		if err != nil {
+			logger.WithError(err).Warnf("Unable to check %s %s for advisories", gem.Name, gem.Version)
+			continue
+		}
+		advisories, err := loadAdvisories(advisoryDB, gem.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, advisory := range advisories {
+			affected, err := advisory.affects(version)
+			if err != nil {
+				logger.WithError(err).Warnf("Skipping advisory %s with invalid versions", advisory.file)
+				continue
+			}
+			if !affected {
+				continue
+			}
+			severity, cvss := advisory.severity()
+			audit.Vulnerabilities = append(audit.Vulnerabilities, Vulnerability{
+				Gem:             gem.Name,
+				Version:         gem.Version,
+				ID:              advisory.id(),
+				Title:           advisory.Title,
+				URL:             advisory.URL,
+				Severity:        severity,
+				CVSS:            cvss,
+				PatchedVersions: append([]string{}, advisory.PatchedVersions...),
+			})
+		}
+	}
+
+	sort.SliceStable(audit.Vulnerabilities, func(i, j int) bool {
+		a, b := audit.Vulnerabilities[i], audit.Vulnerabilities[j]
+		if a.CVSS != b.CVSS {
+			return a.CVSS > b.CVSS
+		}
+		if a.Gem != b.Gem {
+			return a.Gem < b.Gem
+		}
+		return a.ID < b.ID
+	})
+	return audit, nil
+}
+
+// patched returns the patched versions for logs.
+func (v Vulnerability) patched() string {
+	if len(v.PatchedVersions) == 0 {
+		return "none"
+	}
+	return strings.Join(v.PatchedVersions, " or ")
+}
+
+func logAudit(audit *GemAudit) {
+	if len(audit.Vulnerabilities) == 0 {
+		logger.Infof("No advisories for the %d gems in %s", audit.Gems, audit.Lockfile)
+		return
+	}
+	logger.Warnf("Found %d advisory(ies) for the gems in %s, %d without a CVSS score", len(audit.Vulnerabilities), audit.Lockfile, audit.unknownSeverity())
+	for _, vulnerability := range audit.Vulnerabilities {
+		logger.Warnf("    %s %s: %s (%s) %s, patched in %s", vulnerability.Gem, vulnerability.Version, vulnerability.ID, vulnerability.Severity, vulnerability.Title, vulnerability.patched())
+	}
+}
+
+// unknownSeverity returns the number of advisories without a CVSS score.
+func (audit *GemAudit) unknownSeverity() int {
+	count := 0
+	for _, vulnerability := range audit.Vulnerabilities {
+		if vulnerability.Severity == SeverityUnknown {
+			count++
+		}
+	}
+	return count
+}
+
+// applySeverityPolicy fails when advisories are at or above failOnSeverity,
+// if set. Advisories without a CVSS score fail at any severity, as they may
+// well be critical.
+func applySeverityPolicy(audit *GemAudit, failOnSeverity string) error {
+	if failOnSeverity == "" {
+		return nil
+	}
+	failing := 0
+	for _, vulnerability := range audit.Vulnerabilities {
+		if vulnerability.Severity == SeverityUnknown || severityRank(vulnerability.Severity) >= severityRank(failOnSeverity) {
+			failing++
+		}
+	}
+	if failing > 0 {
+		return &VulnerableGemsError{Vulnerabilities: failing, Severity: failOnSeverity}
+	}
+	return nil
+}
+
+// auditGems checks the gems of the application against opts.AdvisoryDB, if
+// set, and adds the result to the report.
+func auditGems(ctx context.Context, repoFolder string, opts Options, report *Report) error {
+	if opts.AdvisoryDB == "" {
+		return nil
+	}
+	audit, err := AuditLockfile(ctx, repoFolder, opts.AdvisoryDB)
+	if err != nil {
+		return err
+	}
+	report.Audit = audit
+	logAudit(audit)
+	return applySeverityPolicy(audit, opts.FailOnSeverity)
+}
+
+// Audit prints the advisories for the gems of the application in args
+// (the current directory by default), as text or JSON.
+func Audit(ctx context.Context, args []string, format string, advisoryDB string, failOnSeverity string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("invalid format '%s', expected %s or %s", format, FormatText, FormatJSON)
+	}
+	if failOnSeverity != "" && !isOneOf(failOnSeverity, severities) {
+		return fmt.Errorf("invalid severity '%s', expected one of %s", failOnSeverity, strings.Join(severities, ", "))
+	}
+	repoFolder := "."
+	if len(args) > 0 {
+		repoFolder = args[0]
+	}
+
+	audit, err := AuditLockfile(ctx, repoFolder, advisoryDB)
+	if err != nil {
+		return err
+	}
+	policyErr := applySeverityPolicy(audit, failOnSeverity)
+
+	if format == FormatJSON {
+		if err := printJSON(audit); err != nil {
+			return err
+		}
+	} else {
+		printAudit(audit)
+	}
+	return policyErr
+}
+
+func printAudit(audit *GemAudit) {
+	w := os.Stdout
+	fmt.Fprintf(w, "Lockfile:    %s\n", audit.Lockfile)
+	if audit.AdvisoryDBCommit != "" {
+		fmt.Fprintf(w, "Advisory DB: %s (%s)\n", audit.AdvisoryDB, audit.AdvisoryDBCommit)
+	} else {
+		fmt.Fprintf(w, "Advisory DB: %s\n", audit.AdvisoryDB)
+	}
+	for _, vulnerability := range audit.Vulnerabilities {
+		fmt.Fprintf(w, "\n%s %s\n", vulnerability.Gem, vulnerability.Version)
+		fmt.Fprintf(w, "    Advisory: %s\n", vulnerability.ID)
+		if vulnerability.CVSS > 0 {
+			fmt.Fprintf(w, "    Severity: %s (CVSS %.1f)\n", vulnerability.Severity, vulnerability.CVSS)
+		} else {
+			fmt.Fprintf(w, "    Severity: %s\n", vulnerability.Severity)
+		}
+		fmt.Fprintf(w, "    Title:    %s\n", vulnerability.Title)
+		if vulnerability.URL != "" {
+			fmt.Fprintf(w, "    URL:      %s\n", vulnerability.URL)
+		}
+		fmt.Fprintf(w, "    Patched:  %s\n", vulnerability.patched())
+	}
+	fmt.Fprintf(w, "\n%d advisory(ies) for %d gems, %d without a CVSS score\n", len(audit.Vulnerabilities), audit.Gems, audit.unknownSeverity())
+}
@@ -0,0 +1,96 @@
+package vcrbpkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// writeFileAtomic writes file with write through a temporary file in the same
+// directory that is renamed to file once it is complete, so no one sees a
+// partial file, even when we are interrupted.
+func writeFileAtomic(file string, perm os.FileMode, write func(w io.Writer) error) error {
+	return writeTempFile(file, perm, write, func(tmp string) error {
+		if err := os.Rename(tmp, file); err != nil {
+			logger.WithError(err).Errorf("Unable to rename %s to %s", tmp, file)
+			return fmt.Errorf("unable to write %s", file)
+		}
+		return nil
+	})
+}
+
+// createFileAtomic is writeFileAtomic that fails with an *OutExistsError
+// when file exists, also when it is created while we write: the complete
+// temporary file is hard linked to file, which fails if it exists.
+func createFileAtomic(file string, perm os.FileMode, write func(w io.Writer) error) error {
+	return writeTempFile(file, perm, write, func(tmp string) error {
+		err := os.Link(tmp, file)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, os.ErrExist) {
+			return &OutExistsError{File: file}
+		}
+
+		// Without hard links, like on FAT, claim file first and replace it
+		logger.WithError(err).Debugf("Unable to link %s to %s, creating it exclusively instead", tmp, file)
+		claimed, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if errors.Is(err, os.ErrExist) {
+			return &OutExistsError{File: file}
+		}
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to create %s", file)
+			return fmt.Errorf("unable to write %s", file)
+		}
+		claimed.Close()
+		if err := os.Rename(tmp, file); err != nil {
+			os.Remove(file)
+			logger.WithError(err).Errorf("Unable to rename %s to %s", tmp, file)
+			return fmt.Errorf("unable to write %s", file)
+		}
+		return nil
+	})
+}
+
+// writeOutFile writes a file we export with createFileAtomic, or
+// writeFileAtomic to overwrite it with force.
+func writeOutFile(file string, force bool, write func(w io.Writer) error) error {
+	if force {
+		return writeFileAtomic(file, 0644, write)
+	}
+	return createFileAtomic(file, 0644, write)
+}
+
+// writeTempFile writes a temporary file next to file with write and has
+// publish move it into place once it is complete.
+func writeTempFile(file string, perm os.FileMode, write func(w io.Writer) error, publish func(tmp string) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*.tmp")
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to create temporary file next to %s", file)
+		return fmt.Errorf("unable to create temporary file next to %s", file)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	// Writes can fail on sync or close, like on a full disk
+	if err := tmp.Sync(); err != nil {
+		logger.WithError(err).Errorf("Unable to write %s", tmp.Name())
+		return fmt.Errorf("unable to write %s", file)
+	}
+	if err := tmp.Close(); err != nil {
+		logger.WithError(err).Errorf("Unable to write %s", tmp.Name())
+		return fmt.Errorf("unable to write %s", file)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		logger.WithError(err).Errorf("Unable to set permissions of %s", tmp.Name())
+		return fmt.Errorf("unable to set permissions of %s", file)
+	}
+	return publish(tmp.Name())
+}
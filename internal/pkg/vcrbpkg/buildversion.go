@@ -0,0 +1,19 @@
+package vcrbpkg
+
+import "runtime/debug"
+
+// vcrbpkgVersion is set when building a release with
+// -ldflags "-X github.com/relaxnow/vcrbpkg/internal/pkg/vcrbpkg.vcrbpkgVersion=v1.2.3".
+var vcrbpkgVersion = ""
+
+// BuildVersion returns the version of vcrbpkg, the release version or the
+// module version when installed with go install.
+func BuildVersion() string {
+	if vcrbpkgVersion != "" {
+		return vcrbpkgVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
@@ -0,0 +1,120 @@
+package vcrbpkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// determineBundlerVersion returns the Bundler version from BUNDLED WITH in the
+// Gemfile.lock, or an empty string to use the Bundler that comes with Ruby.
+func determineBundlerVersion(repoFolder string) string {
+	lockfile, err := parseLockfile(repoFolder)
+	if err != nil {
+		logger.Warn("No Gemfile.lock, using the Bundler version that comes with Ruby")
+		return ""
+	}
+
+	if lockfile.BundledWith == "" {
+		logger.Warn("No BUNDLED WITH in Gemfile.lock, using the Bundler version that comes with Ruby")
+		return ""
+	}
+
+	if !regexp.MustCompile(`^\d+(\.\d+)*$`).MatchString(lockfile.BundledWith) {
+		logger.Warnf("Unrecognized BUNDLED WITH version '%s' in Gemfile.lock, using the Bundler version that comes with Ruby", lockfile.BundledWith)
+		return ""
+	}
+
+	logger.Infof("Found Bundler version: %s", lockfile.BundledWith)
+	return lockfile.BundledWith
+}
+
+// installBundler installs the exact Bundler version in the veracode gemset.
+func installBundler(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string) error {
+	if bundlerVersion == "" {
+		return nil
+	}
+
+	logger.Infof("Installing Bundler %s in the veracode gemset", bundlerVersion)
+
+	cmd := exec.Command(
+		"rvm", rubyVersion.String()+"@veracode", "do",
+		"gem", "install", "bundler",
+		"--version", bundlerVersion,
+		"--no-document")
+	cmd.Dir = repoFolder
+	cmd.Stdout = commandOutput
+	cmd.Stderr = os.Stderr
+
+	if err := runCommand(ctx, cmd); err != nil {
+		logger.WithError(err).Errorf("failed to install bundler %s", bundlerVersion)
+		return fmt.Errorf("failed to install bundler %s for ruby version: %s", bundlerVersion, rubyVersion.String())
+	}
+	return nil
+}
+
+// bundleCommand runs bundle in the veracode gemset, explicitly selecting the
+// Bundler version (bundle _x.y.z_) when the application was locked with one.
+func bundleCommand(rubyVersion Version, bundlerVersion string, args ...string) *exec.Cmd {
+	rvmArgs := []string{rubyVersion.String() + "@veracode", "do", "bundle"}
+	if bundlerVersion != "" {
+		rvmArgs = append(rvmArgs, "_"+bundlerVersion+"_")
+	}
+	return exec.Command("rvm", append(rvmArgs, args...)...)
+}
+
+// bundlerVersionEnv selects the Bundler version for commands that load
+// Bundler without running bundle, like rails server and veracode prepare,
+// otherwise RubyGems activates the newest Bundler in the gemset.
+func bundlerVersionEnv(bundlerVersion string) []string {
+	if bundlerVersion == "" {
+		return nil
+	}
+	return []string{"BUNDLER_VERSION=" + bundlerVersion}
+}
+
+// defaultBundleWithout are the gem groups excluded per Rails environment when
+// not configured otherwise.
+var defaultBundleWithout = map[string][]string{
+	"production": {"development", "test"},
+}
+
+// ParseBundleWithout parses ENV=group1:group2 values into the groups to
+// exclude per Rails environment. An empty list of groups (ENV=) installs all.
+func ParseBundleWithout(values []string) (map[string][]string, error) {
+	bundleWithout := map[string][]string{}
+	for _, value := range values {
+		railsEnv, groups, found := strings.Cut(value, "=")
+		if !found || railsEnv == "" {
+			return nil, fmt.Errorf("invalid bundle without '%s', expected ENV=group1:group2", value)
+		}
+		bundleWithout[railsEnv] = splitGroups(groups)
+	}
+	return bundleWithout, nil
+}
+
+func splitGroups(groups string) []string {
+	return strings.FieldsFunc(groups, func(r rune) bool {
+		return r == ':' || r == ',' || r == ' '
+	})
+}
+
+// bundleWithoutGroups returns the gem groups to exclude for railsEnv.
+func bundleWithoutGroups(bundleWithout map[string][]string, railsEnv string) []string {
+	if groups, found := bundleWithout[railsEnv]; found {
+		return groups
+	}
+	return defaultBundleWithout[railsEnv]
+}
+
+// bundleWithoutEnv configures Bundler to exclude groups for a single run. This
+// replaces bundle install --without, which is removed in Bundler 3 and was
+// remembered in .bundle/config for later runs.
+func bundleWithoutEnv(groups []string) string {
+	return "BUNDLE_WITHOUT=" + strings.Join(groups, ":")
+}
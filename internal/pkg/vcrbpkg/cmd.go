@@ -1,6 +1,33 @@
 package vcrbpkg
 
-import "os"
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// commandOutput is where the output of commands is shown, stdout unless the
+// package is streamed there.
+var commandOutput io.Writer = os.Stdout
+
+// outputToStderr shows logs and the output of commands on stderr, to keep
+// stdout for the package.
+func outputToStderr() {
+	commandOutput = os.Stderr
+	logger.SetOutput(os.Stderr)
+}
+
+// outputToStdout shows logs and the output of commands on stdout again.
+func outputToStdout() {
+	commandOutput = os.Stdout
+	logger.SetOutput(os.Stdout)
+}
 
 type saveOutput struct {
 	savedOutput []byte
@@ -8,5 +35,184 @@ type saveOutput struct {
 
 func (so *saveOutput) Write(p []byte) (n int, err error) {
 	so.savedOutput = append(so.savedOutput, p...)
-	return os.Stdout.Write(p)
+	if _, err = commandOutput.Write(logger.Mask(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// How long a process (group) gets to shut down after being terminated before
+// it is killed.
+const killGracePeriod = 5 * time.Second
+
+// How long the output of a command is still copied after it exited, for
+// background processes that keep its stdout or stderr open.
+const outputDrainTimeout = 2 * time.Second
+
+// runCommand runs cmd in its own process group and waits for it to finish.
+// When ctx is done the whole group is terminated, and killed if it does not
+// stop in time, so grandchildren like compilers building native extensions or
+// the Puma server started through rvm do not outlive it. Anything the command
+// left running in the background is killed when it exits.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	return runProcess(ctx, cmd, true)
+}
+
+// runForegroundCommand runs cmd like runCommand, but in our process group so
+// it can prompt on the terminal, like git clone for credentials. Only the
+// command itself is stopped when ctx is done, Ctrl-C on the terminal reaches
+// the rest of the foreground group by itself.
+func runForegroundCommand(ctx context.Context, cmd *exec.Cmd) error {
+	return runProcess(ctx, cmd, false)
+}
+
+func runProcess(ctx context.Context, cmd *exec.Cmd, group bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if group {
+		setProcessGroup(cmd)
+	}
+	output, err := pipeOutput(cmd)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		output.close()
+		return err
+	}
+	output.started()
+
+	terminate, kill := terminateProcess, killProcess
+	if group {
+		terminate, kill = terminateProcessGroup, killProcessGroup
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			terminate(cmd)
+			select {
+			case <-done:
+			case <-time.After(killGracePeriod):
+				kill(cmd)
+			}
+		case <-done:
+		}
+	}()
+
+	// With the output in pipes we copy ourselves, Wait returns when the
+	// process exits, even if something it started keeps the pipes open
+	err = cmd.Wait()
+	close(done)
+
+	if group {
+		// Clean up anything the command left running in the background
+		killProcessGroup(cmd)
+	}
+	output.wait(outputDrainTimeout)
+	return err
+}
+
+// commandOutputPipes copies the output of a command to writers that are not
+// files, like exec.Cmd does, but without making Wait wait for the copying.
+type commandOutputPipes struct {
+	readers []*os.File
+	writers []*os.File
+	copied  sync.WaitGroup
+}
+
+// pipeOutput replaces the stdout and stderr of cmd that are not files by
+// pipes that are copied to them.
+func pipeOutput(cmd *exec.Cmd) (*commandOutputPipes, error) {
+	pipes := &commandOutputPipes{}
+	stdout := cmd.Stdout
+	var stdoutPipe *os.File
+	for _, output := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		if *output == nil {
+			continue
+		}
+		if _, isFile := (*output).(*os.File); isFile {
+			continue
+		}
+		// Combined output shares a pipe, to keep the order of the output
+		if output == &cmd.Stderr && stdoutPipe != nil && sameWriter(cmd.Stderr, stdout) {
+			cmd.Stderr = stdoutPipe
+			continue
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			pipes.close()
+			return nil, err
+		}
+		pipes.readers = append(pipes.readers, r)
+		pipes.writers = append(pipes.writers, w)
+		pipes.copied.Add(1)
+		go func(dst io.Writer) {
+			defer pipes.copied.Done()
+			_, _ = io.Copy(dst, r)
+		}(*output)
+		if output == &cmd.Stdout {
+			stdoutPipe = w
+		}
+		*output = w
+	}
+	return pipes, nil
+}
+
+// sameWriter returns whether a and b are the same writer, writers that can
+// not be compared are not.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// started closes our copy of the write ends, which the command now has.
+func (p *commandOutputPipes) started() {
+	for _, w := range p.writers {
+		w.Close()
+	}
+}
+
+// wait waits until the output is copied, at most timeout after which the
+// pipes are closed.
+func (p *commandOutputPipes) wait(timeout time.Duration) {
+	copied := make(chan struct{})
+	go func() {
+		p.copied.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-time.After(timeout):
+		logger.Debug("A background process keeps the output of the command open, no longer copying it")
+	}
+	for _, r := range p.readers {
+		r.Close()
+	}
+	<-copied
+}
+
+// close closes all pipes, for when the command did not start.
+func (p *commandOutputPipes) close() {
+	p.started()
+	for _, r := range p.readers {
+		r.Close()
+	}
+	p.copied.Wait()
+}
+
+// outputCommand runs cmd like runCommand, returning its combined output.
+func outputCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := runCommand(ctx, cmd)
+	return output.Bytes(), err
 }
@@ -0,0 +1,208 @@
+package vcrbpkg
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// ExitCoverageTooLow is the exit code when the coverage of the package is
+// below --min-coverage.
+const ExitCoverageTooLow = 3
+
+// coverageDirs are the directories with the Ruby code we expect in the
+// package.
+var coverageDirs = []string{"app", "lib", "config"}
+
+// Coverage is the share of the Ruby files of the application that were
+// compiled into the package.
+type Coverage struct {
+	// Unknown is set when no compiled code was recognized in the package, the
+	// other fields are empty then.
+	Unknown     bool                `json:"unknown,omitempty"`
+	Files       int                 `json:"files"`
+	Compiled    int                 `json:"compiled"`
+	Percent     float64             `json:"percent"`
+	Directories []DirectoryCoverage `json:"directories"`
+	// Missing are the files that were not compiled.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// DirectoryCoverage is the coverage of the files in a directory, like
+// app/models, and its subdirectories.
+type DirectoryCoverage struct {
+	Directory string  `json:"directory"`
+	Files     int     `json:"files"`
+	Compiled  int     `json:"compiled"`
+	Percent   float64 `json:"percent"`
+}
+
+// CoverageError is returned when the coverage is below the minimum, or
+// unknown.
+type CoverageError struct {
+	Percent    float64
+	MinPercent float64
+	Unknown    bool
+}
+
+func (e *CoverageError) Error() string {
+	if e.Unknown {
+		return fmt.Sprintf("coverage is unknown, no compiled code recognized in the package, the minimum is %.1f%%", e.MinPercent)
+	}
+	return fmt.Sprintf("coverage %.1f%% is below the minimum of %.1f%%", e.Percent, e.MinPercent)
+}
+
+// ExitCode makes vcrbpkg exit with ExitCoverageTooLow.
+func (e *CoverageError) ExitCode() int {
+	return ExitCoverageTooLow
+}
+
+// computeCoverage compares the .rb files in coverageDirs with the files
+// compiled into the package, relative to repoFolder.
+func computeCoverage(repoFolder string, compiledFiles []string) (*Coverage, error) {
+	compiled := map[string]bool{}
+	for _, file := range compiledFiles {
+		compiled[file] = true
+	}
+
+	coverage := &Coverage{}
+	directories := map[string]*DirectoryCoverage{}
+	for _, dir := range coverageDirs {
+		root := filepath.Join(repoFolder, dir)
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if path == root && errors.Is(err, fs.ErrNotExist) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if entry.IsDir() || filepath.Ext(path) != ".rb" {
+				return nil
+			}
+
+			relative, err := filepath.Rel(repoFolder, path)
+			if err != nil {
+				return err
+			}
+			relative = filepath.ToSlash(relative)
+
+			directory := coverageDirectory(relative)
+			if directories[directory] == nil {
+				directories[directory] = &DirectoryCoverage{Directory: directory}
+			}
+			coverage.Files++
+			directories[directory].Files++
+			if compiled[relative] {
+				coverage.Compiled++
+				directories[directory].Compiled++
+			} else {
+				coverage.Missing = append(coverage.Missing, relative)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to list the Ruby files in %s", root)
+			return nil, fmt.Errorf("unable to list the Ruby files in %s", root)
+		}
+	}
+
+	coverage.Percent = percent(coverage.Compiled, coverage.Files)
+	for _, directory := range directories {
+		directory.Percent = percent(directory.Compiled, directory.Files)
+		coverage.Directories = append(coverage.Directories, *directory)
+	}
+	sort.Slice(coverage.Directories, func(i, j int) bool {
+		return coverage.Directories[i].Directory < coverage.Directories[j].Directory
+	})
+	return coverage, nil
+}
+
+// coverageDirectory groups files by their first two directories, like
+// app/models or config, so the breakdown is neither too coarse nor too long.
+func coverageDirectory(file string) string {
+	parts := strings.Split(file, "/")
+	if len(parts) <= 2 {
+		return parts[0]
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+func percent(part int, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(part) * 100 / float64(total)
+}
+
+// logCoverage prints the coverage by directory.
+func logCoverage(coverage *Coverage) {
+	logger.Infof("Coverage: %d of %d Ruby files in %s compiled (%.1f%%)",
+		coverage.Compiled, coverage.Files, strings.Join(coverageDirs, ", "), coverage.Percent)
+	for _, directory := range coverage.Directories {
+		logger.Infof("    %-30s %4d of %4d (%.1f%%)", directory.Directory, directory.Compiled, directory.Files, directory.Percent)
+	}
+	for _, file := range coverage.Missing {
+		logger.Debugf("Not compiled: %s", file)
+	}
+}
+
+// packageCompiledFiles returns the application files with instruction
+// sequences in the package, relative to repoFolder. The disasm has the paths
+// of the machine that ran veracode prepare, if they are not in repoFolder
+// they are made relative to the guessed root of the application.
+func packageCompiledFiles(repoFolder string, info *PackageInfo) []string {
+	var appFiles []string
+	for file := range info.compiled {
+		if !isGemPath(file) {
+			appFiles = append(appFiles, file)
+		}
+	}
+	root := appRoot(appFiles)
+
+	var files []string
+	for _, file := range appFiles {
+		relative := relativeToApp(repoFolder, file)
+		if path.IsAbs(relative) {
+			relative = strings.TrimPrefix(strings.TrimPrefix(file, root), "/")
+		}
+		files = append(files, relative)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// checkCoverage computes the coverage of the package, adds it to the report
+// and fails when it is below minPercent (if set) or unknown with minPercent.
+func checkCoverage(repoFolder string, packagedFile string, minPercent float64, report *Report) error {
+	info, err := InspectPackage(packagedFile)
+	if err != nil {
+		return err
+	}
+	// Compiled code we do not recognize, like from another version of the
+	// gem, does not mean nothing was compiled
+	if info.InstructionSequences == 0 {
+		logger.Warn("Coverage unknown, no compiled code recognized in the package")
+		report.Coverage = &Coverage{Unknown: true}
+		if minPercent > 0 {
+			return &CoverageError{MinPercent: minPercent, Unknown: true}
+		}
+		return nil
+	}
+	coverage, err := computeCoverage(repoFolder, packageCompiledFiles(repoFolder, info))
+	if err != nil {
+		return err
+	}
+	report.Coverage = coverage
+	logCoverage(coverage)
+
+	if minPercent > 0 && coverage.Percent < minPercent {
+		return &CoverageError{Percent: coverage.Percent, MinPercent: minPercent}
+	}
+	return nil
+}
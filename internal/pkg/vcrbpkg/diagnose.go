@@ -0,0 +1,134 @@
+package vcrbpkg
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// Steps that produce output we know how to diagnose.
+const (
+	stepRvmInstall      = "rvm install"
+	stepBundleInstall   = "bundle install"
+	stepRailsServer     = "rails server"
+	stepVeracodePrepare = "veracode prepare"
+)
+
+//go:embed known_failures.json
+var embeddedKnownFailures []byte
+
+// KnownFailure describes a common failure of one of the tools vcrbpkg runs,
+// recognized by a regular expression on the output of that tool.
+type KnownFailure struct {
+	ID string `json:"id"`
+	// Steps this failure may occur in, empty means any step.
+	Steps []string `json:"steps"`
+	// Pattern is matched against the tool output, submatches can be used as
+	// $1, $2, ... in Diagnosis and Fix.
+	Pattern   string `json:"pattern"`
+	Diagnosis string `json:"diagnosis"`
+	Fix       string `json:"fix"`
+
+	re *regexp.Regexp
+}
+
+// Diagnosis is a known failure recognized in the output of a step.
+type Diagnosis struct {
+	ID        string `json:"id"`
+	Step      string `json:"step"`
+	Diagnosis string `json:"diagnosis"`
+	Fix       string `json:"fix"`
+	Match     string `json:"match"`
+}
+
+// loadKnownFailures loads the embedded known failures, with the known failures
+// from extraFile (if any) taking precedence.
+func loadKnownFailures(extraFile string) ([]KnownFailure, error) {
+	var knownFailures []KnownFailure
+
+	if extraFile != "" {
+		content, err := os.ReadFile(extraFile)
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to read known failures file %s", extraFile)
+			return nil, fmt.Errorf("unable to read known failures file %s", extraFile)
+		}
+		extra, err := parseKnownFailures(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid known failures file %s: %v", extraFile, err)
+		}
+		knownFailures = append(knownFailures, extra...)
+	}
+
+	embedded, err := parseKnownFailures(embeddedKnownFailures)
+	if err != nil {
+		// Only happens when someone breaks known_failures.json
+		logger.Panicf("Invalid embedded known failures: %v", err)
+	}
+
+	return append(knownFailures, embedded...), nil
+}
+
+func parseKnownFailures(content []byte) ([]KnownFailure, error) {
+	var knownFailures []KnownFailure
+	if err := json.Unmarshal(content, &knownFailures); err != nil {
+		return nil, err
+	}
+
+	for i := range knownFailures {
+		knownFailure := &knownFailures[i]
+		if knownFailure.ID == "" {
+			return nil, fmt.Errorf("known failure #%d has no id", i+1)
+		}
+		if knownFailure.Pattern == "" {
+			return nil, fmt.Errorf("known failure '%s' has no pattern", knownFailure.ID)
+		}
+		re, err := regexp.Compile(knownFailure.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("known failure '%s' has an invalid pattern: %v", knownFailure.ID, err)
+		}
+		knownFailure.re = re
+	}
+	return knownFailures, nil
+}
+
+func (kf KnownFailure) appliesTo(step string) bool {
+	if len(kf.Steps) == 0 {
+		return true
+	}
+	for _, s := range kf.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// diagnose returns the known failures found in the output of step, at most
+// one diagnosis per known failure.
+func diagnose(knownFailures []KnownFailure, step string, output []byte) []Diagnosis {
+	var diagnoses []Diagnosis
+	for _, knownFailure := range knownFailures {
+		if !knownFailure.appliesTo(step) {
+			continue
+		}
+
+		submatches := knownFailure.re.FindSubmatchIndex(output)
+		if submatches == nil {
+			continue
+		}
+
+		diagnoses = append(diagnoses, Diagnosis{
+			ID:        knownFailure.ID,
+			Step:      step,
+			Diagnosis: string(knownFailure.re.Expand(nil, []byte(knownFailure.Diagnosis), output, submatches)),
+			Fix:       string(knownFailure.re.Expand(nil, []byte(knownFailure.Fix), output, submatches)),
+			Match:     strings.TrimSpace(string(output[submatches[0]:submatches[1]])),
+		})
+	}
+	return diagnoses
+}
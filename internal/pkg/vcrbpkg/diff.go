@@ -0,0 +1,305 @@
+package vcrbpkg
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// ExitPackagesDiffer is the exit code of diff when the packages differ
+// materially.
+const ExitPackagesDiffer = 4
+
+// PackageDiff is what changed between two packages.
+type PackageDiff struct {
+	Old     string   `json:"old"`
+	New     string   `json:"new"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+	// Metadata that differs, like the Ruby or Rails version.
+	Metadata             []MetadataChange  `json:"metadata"`
+	InstructionSequences CountChange       `json:"instruction_sequences"`
+	CompiledFiles        CountChange       `json:"compiled_files"`
+	Directories          []DirectoryChange `json:"directories"`
+	// Material is set when the packages differ in more than the metadata
+	// files, which change on every run.
+	Material bool `json:"material"`
+}
+
+// MetadataChange is a metadata field that differs.
+type MetadataChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// CountChange is a count in both packages.
+type CountChange struct {
+	Old int `json:"old"`
+	New int `json:"new"`
+}
+
+// DirectoryChange is a source directory with a different number of compiled
+// files or instruction sequences.
+type DirectoryChange struct {
+	Directory            string      `json:"directory"`
+	Files                CountChange `json:"files"`
+	InstructionSequences CountChange `json:"instruction_sequences"`
+}
+
+// PackagesDifferError is returned by Diff when the packages differ materially.
+type PackagesDifferError struct {
+	Old string
+	New string
+}
+
+func (e *PackagesDifferError) Error() string {
+	return fmt.Sprintf("packages %s and %s differ", e.Old, e.New)
+}
+
+// ExitCode makes vcrbpkg exit with ExitPackagesDiffer.
+func (e *PackagesDifferError) ExitCode() int {
+	return ExitPackagesDiffer
+}
+
+// appRootPlaceholder replaces the root of the application in disasm.
+const appRootPlaceholder = "<app>"
+
+// hashCompiledEntries returns the sha256 of the entries with instruction
+// sequences, with the root of the application replaced. The disasm has the
+// paths of the temporary clone veracode prepare ran in, which differ on every
+// run, so the CRC32 of the entries differ for the same code.
+func hashCompiledEntries(info *PackageInfo) (map[string]string, error) {
+	hashes := map[string]string{}
+	if len(info.disasm) == 0 {
+		return hashes, nil
+	}
+
+	reader, err := zip.OpenReader(info.File)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to open package %s as zip", info.File)
+		return nil, fmt.Errorf("unable to open package %s as zip: %v", info.File, err)
+	}
+	defer reader.Close()
+
+	for _, f := range reader.File {
+		if !info.disasm[f.Name] {
+			continue
+		}
+		hash, err := hashNormalizedEntry(f, info.root)
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to read %s in package %s", f.Name, info.File)
+			return nil, fmt.Errorf("unable to read %s in package %s: %v", f.Name, info.File, err)
+		}
+		hashes[f.Name] = hash
+	}
+	return hashes, nil
+}
+
+func hashNormalizedEntry(f *zip.File, root string) (string, error) {
+	entry, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer entry.Close()
+
+	hash := sha256.New()
+	scanner := bufio.NewScanner(entry)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if root != "" {
+			line = strings.ReplaceAll(line, root, appRootPlaceholder)
+		}
+		io.WriteString(hash, line+"\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// entryChanged returns whether the entry name differs between the packages,
+// by the normalized content for compiled entries in both.
+func entryChanged(name string, oldFile *zip.File, newFile *zip.File, oldHashes map[string]string, newHashes map[string]string) bool {
+	oldHash, oldCompiled := oldHashes[name]
+	newHash, newCompiled := newHashes[name]
+	if oldCompiled && newCompiled {
+		return oldHash != newHash
+	}
+	return oldFile.CRC32 != newFile.CRC32 || oldFile.UncompressedSize64 != newFile.UncompressedSize64
+}
+
+// diffPackages compares the old and new package, compiled entries by the
+// hashes of hashCompiledEntries.
+func diffPackages(oldInfo *PackageInfo, newInfo *PackageInfo, oldHashes map[string]string, newHashes map[string]string) *PackageDiff {
+	diff := &PackageDiff{
+		Old:                  oldInfo.File,
+		New:                  newInfo.File,
+		Added:                []string{},
+		Removed:              []string{},
+		Changed:              []string{},
+		Metadata:             []MetadataChange{},
+		InstructionSequences: CountChange{oldInfo.InstructionSequences, newInfo.InstructionSequences},
+		CompiledFiles:        CountChange{oldInfo.CompiledFiles, newInfo.CompiledFiles},
+		Directories:          []DirectoryChange{},
+	}
+
+	metadataFiles := map[string]bool{}
+	for _, info := range []*PackageInfo{oldInfo, newInfo} {
+		for _, file := range info.Metadata.Files {
+			metadataFiles[file] = true
+		}
+	}
+
+	for name, oldFile := range oldInfo.files {
+		newFile, found := newInfo.files[name]
+		switch {
+		case !found:
+			diff.Removed = append(diff.Removed, name)
+		case entryChanged(name, oldFile, newFile, oldHashes, newHashes):
+			diff.Changed = append(diff.Changed, name)
+		default:
+			continue
+		}
+		diff.Material = diff.Material || !metadataFiles[name]
+	}
+	for name := range newInfo.files {
+		if _, found := oldInfo.files[name]; !found {
+			diff.Added = append(diff.Added, name)
+			diff.Material = diff.Material || !metadataFiles[name]
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	for _, field := range []struct {
+		name     string
+		old, new string
+	}{
+		{"ruby_version", oldInfo.Metadata.RubyVersion, newInfo.Metadata.RubyVersion},
+		{"rails_version", oldInfo.Metadata.RailsVersion, newInfo.Metadata.RailsVersion},
+		{"rails_env", oldInfo.Metadata.RailsEnv, newInfo.Metadata.RailsEnv},
+		{"veracode_version", oldInfo.Metadata.VeracodeVersion, newInfo.Metadata.VeracodeVersion},
+	} {
+		if field.old != field.new {
+			diff.Metadata = append(diff.Metadata, MetadataChange{Field: field.name, Old: field.old, New: field.new})
+			diff.Material = true
+		}
+	}
+
+	directories := map[string]*DirectoryChange{}
+	directory := func(name string) *DirectoryChange {
+		if directories[name] == nil {
+			directories[name] = &DirectoryChange{Directory: name}
+		}
+		return directories[name]
+	}
+	for _, d := range oldInfo.Directories {
+		directory(d.Directory).Files.Old = d.Files
+		directory(d.Directory).InstructionSequences.Old = d.InstructionSequences
+	}
+	for _, d := range newInfo.Directories {
+		directory(d.Directory).Files.New = d.Files
+		directory(d.Directory).InstructionSequences.New = d.InstructionSequences
+	}
+	for _, d := range directories {
+		if d.Files.Old != d.Files.New || d.InstructionSequences.Old != d.InstructionSequences.New {
+			diff.Directories = append(diff.Directories, *d)
+		}
+	}
+	sort.Slice(diff.Directories, func(i, j int) bool { return diff.Directories[i].Directory < diff.Directories[j].Directory })
+	if len(diff.Directories) > 0 || diff.InstructionSequences.Old != diff.InstructionSequences.New {
+		diff.Material = true
+	}
+	return diff
+}
+
+// Diff prints the differences between the packages in args, as text or JSON.
+// A *PackagesDifferError is returned when they differ materially.
+func Diff(args []string, format string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("invalid format '%s', expected %s or %s", format, FormatText, FormatJSON)
+	}
+
+	oldInfo, err := InspectPackage(args[0])
+	if err != nil {
+		return err
+	}
+	newInfo, err := InspectPackage(args[1])
+	if err != nil {
+		return err
+	}
+
+	oldHashes, err := hashCompiledEntries(oldInfo)
+	if err != nil {
+		return err
+	}
+	newHashes, err := hashCompiledEntries(newInfo)
+	if err != nil {
+		return err
+	}
+
+	diff := diffPackages(oldInfo, newInfo, oldHashes, newHashes)
+	if format == FormatJSON {
+		if err := printJSON(diff); err != nil {
+			return err
+		}
+	} else {
+		printPackageDiff(diff)
+	}
+
+	if diff.Material {
+		return &PackagesDifferError{Old: diff.Old, New: diff.New}
+	}
+	return nil
+}
+
+func printPackageDiff(diff *PackageDiff) {
+	w := os.Stdout
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", diff.Old, diff.New)
+
+	for _, change := range diff.Metadata {
+		fmt.Fprintf(w, "\n%s: %s => %s", change.Field, orUnknown(change.Old), orUnknown(change.New))
+	}
+	if len(diff.Metadata) > 0 {
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "\nInstruction sequences: %d => %d (%+d)\n", diff.InstructionSequences.Old, diff.InstructionSequences.New,
+		diff.InstructionSequences.New-diff.InstructionSequences.Old)
+	fmt.Fprintf(w, "Compiled files:        %d => %d (%+d)\n", diff.CompiledFiles.Old, diff.CompiledFiles.New,
+		diff.CompiledFiles.New-diff.CompiledFiles.Old)
+	for _, d := range diff.Directories {
+		fmt.Fprintf(w, "    %-30s %4d => %4d files, %6d => %6d iseqs\n", d.Directory,
+			d.Files.Old, d.Files.New, d.InstructionSequences.Old, d.InstructionSequences.New)
+	}
+
+	if len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, name := range diff.Added {
+		fmt.Fprintf(w, "A %s\n", name)
+	}
+	for _, name := range diff.Removed {
+		fmt.Fprintf(w, "D %s\n", name)
+	}
+	for _, name := range diff.Changed {
+		fmt.Fprintf(w, "M %s\n", name)
+	}
+
+	if diff.Material {
+		fmt.Fprintln(w, "\nThe packages differ")
+	} else {
+		fmt.Fprintln(w, "\nThe packages do not differ materially")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package vcrbpkg
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeDiskSpace is unknown on other platforms, the fields of statfs differ
+// between them.
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package vcrbpkg
+
+import "golang.org/x/sys/unix"
+
+// freeDiskSpace returns the bytes available to unprivileged users on the
+// filesystem containing path.
+func freeDiskSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	// Bsize is an int64 on Linux and an uint32 on macOS
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,210 @@
+package vcrbpkg
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// Free disk space needed to compile Ruby and install the gems of a typical app.
+const (
+	diskSpaceWarnBytes = 5 << 30
+	diskSpaceFailBytes = 1 << 30
+)
+
+// doctorCheck is the outcome of a single preflight check.
+type doctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	// Packages that resolve the check if it did not pass.
+	Packages map[string]string
+}
+
+// Doctor checks if the system has everything needed to package the Rails
+// application in the given folder (the current directory by default) and prints
+// the distribution packages to install for anything that is missing.
+func Doctor(args []string) error {
+	repoFolder := "."
+	if len(args) > 0 {
+		repoFolder = args[0]
+	}
+
+	var checks []doctorCheck
+	checks = append(checks,
+		checkCommand("ruby", checkFail),
+		checkCommand("rvm", checkFail),
+		checkCommand("git", checkWarn),
+	)
+	for _, tool := range buildTools {
+		checks = append(checks, checkSystemTool(tool))
+	}
+	for _, library := range rubyBuildLibraries {
+		checks = append(checks, checkSystemLibrary(library.Name, library, checkFail))
+	}
+	checks = append(checks, checkOpenSSLVersion(repoFolder))
+	checks = append(checks, checkDiskSpace(repoFolder), checkDiskSpace(os.TempDir()))
+	checks = append(checks, checkGemLibraries(repoFolder)...)
+
+	failed := printDoctorChecks(checks)
+	if failed > 0 {
+		return fmt.Errorf("doctor found %d problem(s) that will prevent packaging", failed)
+	}
+	return nil
+}
+
+func checkCommand(command string, statusIfMissing string) doctorCheck {
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return doctorCheck{Name: command, Status: statusIfMissing, Detail: "not found on PATH"}
+	}
+	return doctorCheck{Name: command, Status: checkOK, Detail: path}
+}
+
+func checkSystemTool(tool systemTool) doctorCheck {
+	path, found := tool.find()
+	if !found {
+		return doctorCheck{
+			Name:     tool.Name,
+			Status:   checkFail,
+			Detail:   "none of " + strings.Join(tool.Binaries, ", ") + " found on PATH",
+			Packages: tool.Packages,
+		}
+	}
+	return doctorCheck{Name: tool.Name, Status: checkOK, Detail: path}
+}
+
+func checkSystemLibrary(name string, library systemLibrary, statusIfMissing string) doctorCheck {
+	location, found := library.find()
+	if !found {
+		return doctorCheck{
+			Name:     name,
+			Status:   statusIfMissing,
+			Detail:   "headers not found (" + strings.Join(library.Headers, ", ") + ")",
+			Packages: library.Packages,
+		}
+	}
+	return doctorCheck{Name: name, Status: checkOK, Detail: location}
+}
+
+// checkOpenSSLVersion warns when the system has OpenSSL 3 but the application
+// needs a Ruby that only builds against OpenSSL 1.1.
+func checkOpenSSLVersion(repoFolder string) doctorCheck {
+	check := doctorCheck{Name: "OpenSSL version"}
+
+	output, err := exec.Command("openssl", "version").Output()
+	if err != nil {
+		check.Status = checkWarn
+		check.Detail = "unable to run openssl version"
+		return check
+	}
+	version := strings.TrimSpace(string(output))
+
+	if !strings.HasPrefix(version, "OpenSSL 3") {
+		check.Status = checkOK
+		check.Detail = version
+		return check
+	}
+
+	if _, err := os.Stat(filepath.Join(repoFolder, "Gemfile")); err != nil {
+		check.Status = checkOK
+		check.Detail = version + " (no Gemfile, not checking Ruby compatibility)"
+		return check
+	}
+
+	rubyVersion := determineRubyVersion(repoFolder)
+	if needsRvmOpenSSL(rubyVersion) {
+		check.Status = checkWarn
+		check.Detail = fmt.Sprintf("%s does not build Ruby %s, vcrbpkg will use 'rvm pkg install openssl' instead", version, rubyVersion)
+		return check
+	}
+
+	check.Status = checkOK
+	check.Detail = fmt.Sprintf("%s, compatible with Ruby %s", version, rubyVersion)
+	return check
+}
+
+func checkDiskSpace(path string) doctorCheck {
+	check := doctorCheck{Name: "Disk space in " + path}
+
+	free, err := freeDiskSpace(path)
+	if err != nil {
+		check.Status = checkWarn
+		check.Detail = fmt.Sprintf("unable to determine free disk space: %v", err)
+		return check
+	}
+
+	check.Detail = fmt.Sprintf("%.1f GiB free", float64(free)/(1<<30))
+	switch {
+	case free < diskSpaceFailBytes:
+		check.Status = checkFail
+	case free < diskSpaceWarnBytes:
+		check.Status = checkWarn
+	default:
+		check.Status = checkOK
+	}
+	return check
+}
+
+// checkGemLibraries checks the native libraries needed by the gems with C
+// extensions in the Gemfile.lock of the application.
+func checkGemLibraries(repoFolder string) []doctorCheck {
+	lockfile, err := parseLockfile(repoFolder)
+	if err != nil {
+		return []doctorCheck{{
+			Name:   "Gemfile.lock",
+			Status: checkWarn,
+			Detail: "not found, unable to check native libraries needed by gems",
+		}}
+	}
+
+	var checks []doctorCheck
+	for _, gemLibrary := range requiredGemLibraries(lockfile) {
+		statusIfMissing := checkFail
+		if gemLibrary.Optional {
+			statusIfMissing = checkWarn
+		}
+		name := fmt.Sprintf("%s (needed by %s)", gemLibrary.Library.Name, gemLibrary.Gem)
+		checks = append(checks, checkSystemLibrary(name, gemLibrary.Library, statusIfMissing))
+	}
+	return checks
+}
+
+// printDoctorChecks prints the checks and the packages that would fix them,
+// returning the number of failed checks.
+func printDoctorChecks(checks []doctorCheck) int {
+	failed := 0
+	var packages []map[string]string
+	for _, check := range checks {
+		fmt.Printf("[%-4s] %s: %s\n", check.Status, check.Name, check.Detail)
+		if check.Status == checkFail {
+			failed++
+		}
+		if check.Status != checkOK && check.Packages != nil {
+			packages = append(packages, check.Packages)
+		}
+	}
+
+	if len(packages) == 0 {
+		return failed
+	}
+
+	fmt.Println()
+	distros := []string{distroDebian, distroRHEL, distroAlpine}
+	if distro := detectDistro(); distro != "" {
+		distros = []string{distro}
+	}
+	for _, distro := range distros {
+		fmt.Printf("To install the missing dependencies on %s:\n", distroNames[distro])
+		fmt.Printf("    %s\n", installCommand(distro, uniquePackages(distro, packages...)))
+	}
+	return failed
+}
@@ -0,0 +1,134 @@
+package vcrbpkg
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// hermeticEnvAllowList are the variables passed to commands in hermetic mode,
+// names can end with * to match a prefix.
+var hermeticEnvAllowList = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "TZ", "TMPDIR",
+	"LANG", "LANGUAGE", "LC_*",
+	// RVM settings, rvm sets up the Ruby and gem environment itself
+	"rvm_*",
+	// Needed for bundle install behind a proxy or with a custom CA
+	"http_proxy", "https_proxy", "no_proxy", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+}
+
+// baseEnv is the environment commands start from: our own environment, or in
+// hermetic mode only the allow-listed variables and those in opts.PassEnv.
+func baseEnv(opts Options) []string {
+	if !opts.Hermetic {
+		return os.Environ()
+	}
+
+	var env []string
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+		if envAllowed(name, opts) {
+			env = append(env, variable)
+		}
+	}
+	return env
+}
+
+// hostEnv returns the value of our environment variable name if it is passed
+// to commands.
+func hostEnv(name string, opts Options) string {
+	if opts.Hermetic && !envAllowed(name, opts) {
+		return ""
+	}
+	return os.Getenv(name)
+}
+
+func envAllowed(name string, opts Options) bool {
+	for _, patterns := range [][]string{hermeticEnvAllowList, opts.PassEnv} {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bundleEnv is the environment for Bundler commands installing the gems for
+// railsEnv.
+func bundleEnv(opts Options, railsEnv string) []string {
+	env := baseEnv(opts)
+	env = append(env, bundleWithoutEnv(bundleWithoutGroups(opts.BundleWithout, railsEnv)))
+	return append(env, extraEnv(opts)...)
+}
+
+// appEnv is the environment for commands that boot the application in
+// railsEnv with bundlerVersion, like rails server and veracode prepare.
+func appEnv(repoFolder string, opts Options, railsEnv string, bundlerVersion string) []string {
+	env := bundleEnv(opts, railsEnv)
+	env = append(env, "RAILS_ENV="+railsEnv)
+	env = append(env, bundlerVersionEnv(bundlerVersion)...)
+
+	if len(opts.Shims) > 0 {
+		rubyOpt := hostEnv("RUBYOPT", opts)
+		if value, found := opts.Env["RUBYOPT"]; found {
+			rubyOpt = value
+		}
+		for _, shim := range opts.Shims {
+			shimPath, _ := filepath.Abs(filepath.Join(repoFolder, shim))
+			rubyOpt = strings.TrimSpace(rubyOpt + " -r" + shimPath)
+		}
+		env = append(env, "RUBYOPT="+rubyOpt)
+	}
+	return env
+}
+
+// extraEnv returns the configured environment variables in a stable order.
+func extraEnv(opts Options) []string {
+	var env []string
+	for key, value := range opts.Env {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// Variables that likely hold secrets, and credentials in URLs like
+// DATABASE_URL.
+var (
+	secretEnvNameRegex  = regexp.MustCompile(`(?i)SECRET|TOKEN|PASSW|KEY|CREDENTIAL|AUTH|COOKIE|PRIVATE|SESSION`)
+	urlCredentialsRegex = regexp.MustCompile(`://[^/@\s]+@`)
+)
+
+const redacted = "[REDACTED]"
+
+// redactEnv hides the value of a NAME=VALUE variable if it looks like a secret.
+func redactEnv(variable string) string {
+	name, value, _ := strings.Cut(variable, "=")
+	if secretEnvNameRegex.MatchString(name) && value != "" {
+		return name + "=" + redacted
+	}
+	return name + "=" + urlCredentialsRegex.ReplaceAllString(value, "://"+redacted+"@")
+}
+
+// logEnv logs the environment of the command for step at debug level, with
+// secrets redacted.
+func logEnv(step string, env []string) {
+	if env == nil {
+		logger.Debugf("Environment for %s: inherited from vcrbpkg", step)
+		return
+	}
+
+	sorted := append([]string(nil), env...)
+	sort.Strings(sorted)
+	logger.Debugf("Environment for %s:", step)
+	for _, variable := range sorted {
+		logger.Debugf("    %s", redactEnv(variable))
+	}
+}
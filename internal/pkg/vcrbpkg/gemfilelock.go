@@ -0,0 +1,158 @@
+package vcrbpkg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// Lockfile is the parsed content of a Gemfile.lock.
+type Lockfile struct {
+	Gems         []LockedGem
+	Dependencies []GemDependency
+	Platforms    []string
+	RubyVersion  string
+	BundledWith  string
+}
+
+// LockedGem is a single gem specification from a Gemfile.lock.
+type LockedGem struct {
+	Name         string
+	Version      string
+	Platform     string
+	Source       GemSource
+	Dependencies []GemDependency
+}
+
+// GemSource is the GEM, GIT or PATH section a gem was locked from.
+type GemSource struct {
+	Type     string
+	Remote   string
+	Revision string
+	Branch   string
+	Tag      string
+	Ref      string
+}
+
+// GemDependency is a dependency on a gem with an optional version requirement.
+type GemDependency struct {
+	Name        string
+	Requirement string
+}
+
+var (
+	lockedGemRegex     = regexp.MustCompile(`^ {4}([^ (]+) \(([^)]+)\)$`)
+	gemDependencyRegex = regexp.MustCompile(`^ {2}( {4})?([^ (!]+)!?(?: \(([^)]+)\))?$`)
+)
+
+// parseLockfile parses the Gemfile.lock in repoFolder.
+func parseLockfile(repoFolder string) (*Lockfile, error) {
+	lockfilePath := filepath.Join(repoFolder, "Gemfile.lock")
+	file, err := os.Open(lockfilePath)
+	if err != nil {
+		logger.WithError(err).Warnf("Unable to open %s", lockfilePath)
+		return nil, fmt.Errorf("unable to open %s", lockfilePath)
+	}
+	defer file.Close()
+
+	lockfile := &Lockfile{}
+	var section string
+	var source GemSource
+	var lastGem *LockedGem
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \r")
+		if line == "" {
+			continue
+		}
+
+		// Section headers are the only lines that are not indented
+		if !strings.HasPrefix(line, " ") {
+			section = line
+			source = GemSource{Type: section}
+			lastGem = nil
+			continue
+		}
+
+		switch section {
+		case "GEM", "GIT", "PATH", "PLUGIN SOURCE":
+			if key, value, found := strings.Cut(strings.TrimSpace(line), ": "); found && !strings.HasPrefix(line, "    ") {
+				switch key {
+				case "remote":
+					source.Remote = value
+				case "revision":
+					source.Revision = value
+				case "branch":
+					source.Branch = value
+				case "tag":
+					source.Tag = value
+				case "ref":
+					source.Ref = value
+				}
+				continue
+			}
+
+			if match := lockedGemRegex.FindStringSubmatch(line); match != nil {
+				version, platform := splitGemPlatform(match[2])
+				lockfile.Gems = append(lockfile.Gems, LockedGem{
+					Name:     match[1],
+					Version:  version,
+					Platform: platform,
+					Source:   source,
+				})
+				lastGem = &lockfile.Gems[len(lockfile.Gems)-1]
+				continue
+			}
+
+			if match := gemDependencyRegex.FindStringSubmatch(line); match != nil && match[1] != "" && lastGem != nil {
+				lastGem.Dependencies = append(lastGem.Dependencies, GemDependency{Name: match[2], Requirement: match[3]})
+			}
+		case "DEPENDENCIES":
+			if match := gemDependencyRegex.FindStringSubmatch(line); match != nil && match[1] == "" {
+				lockfile.Dependencies = append(lockfile.Dependencies, GemDependency{Name: match[2], Requirement: match[3]})
+			}
+		case "PLATFORMS":
+			lockfile.Platforms = append(lockfile.Platforms, strings.TrimSpace(line))
+		case "RUBY VERSION":
+			lockfile.RubyVersion = strings.TrimPrefix(strings.TrimSpace(line), "ruby ")
+		case "BUNDLED WITH":
+			lockfile.BundledWith = strings.TrimSpace(line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		logger.WithError(err).Warnf("Error reading %s", lockfilePath)
+		return nil, fmt.Errorf("error reading %s", lockfilePath)
+	}
+
+	return lockfile, nil
+}
+
+// splitGemPlatform splits a locked version like 1.15.4-x86_64-linux into
+// version and platform.
+func splitGemPlatform(versionAndPlatform string) (string, string) {
+	version, platform, _ := strings.Cut(versionAndPlatform, "-")
+	return version, platform
+}
+
+// Gem returns the first locked gem with name, if any.
+func (l *Lockfile) Gem(name string) (LockedGem, bool) {
+	for _, gem := range l.Gems {
+		if gem.Name == name {
+			return gem, true
+		}
+	}
+	return LockedGem{}, false
+}
+
+// HasGem returns whether a gem with name is locked.
+func (l *Lockfile) HasGem(name string) bool {
+	_, found := l.Gem(name)
+	return found
+}
@@ -0,0 +1,122 @@
+package vcrbpkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLockfile = `GIT
+  remote: https://github.com/rails/rails-controller-testing.git
+  revision: 8e9e3d6b4d3b5cdd4a8e5a9a8e2b1f2e3c4d5e6f
+  branch: main
+  specs:
+    rails-controller-testing (1.0.5)
+      actionpack (>= 5.0.1.rc1)
+      actionview (>= 5.0.1.rc1)
+
+PATH
+  remote: engines/admin
+  specs:
+    admin (0.1.0)
+      rails
+
+GEM
+  remote: https://rubygems.org/
+  specs:
+    actionpack (7.0.4.3)
+      rack (~> 2.0, >= 2.2.0)
+    actionview (7.0.4.3)
+    nokogiri (1.15.4-x86_64-linux)
+      racc (~> 1.4)
+    nokogiri (1.15.4-arm64-darwin)
+      racc (~> 1.4)
+    rack (2.2.7)
+    racc (1.7.1)
+    rails (7.0.4.3)
+
+PLATFORMS
+  arm64-darwin
+  x86_64-linux
+
+DEPENDENCIES
+  admin!
+  nokogiri (~> 1.15)
+  rails (~> 7.0.4, >= 7.0.4.3)
+  rails-controller-testing!
+
+RUBY VERSION
+   ruby 3.2.2p53
+
+BUNDLED WITH
+   2.4.10
+`
+
+func TestParseLockfile(t *testing.T) {
+	git := GemSource{Type: "GIT", Remote: "https://github.com/rails/rails-controller-testing.git", Revision: "8e9e3d6b4d3b5cdd4a8e5a9a8e2b1f2e3c4d5e6f", Branch: "main"}
+	path := GemSource{Type: "PATH", Remote: "engines/admin"}
+	gem := GemSource{Type: "GEM", Remote: "https://rubygems.org/"}
+	want := &Lockfile{
+		Gems: []LockedGem{
+			{Name: "rails-controller-testing", Version: "1.0.5", Source: git, Dependencies: []GemDependency{
+				{Name: "actionpack", Requirement: ">= 5.0.1.rc1"},
+				{Name: "actionview", Requirement: ">= 5.0.1.rc1"},
+			}},
+			{Name: "admin", Version: "0.1.0", Source: path, Dependencies: []GemDependency{{Name: "rails"}}},
+			{Name: "actionpack", Version: "7.0.4.3", Source: gem, Dependencies: []GemDependency{{Name: "rack", Requirement: "~> 2.0, >= 2.2.0"}}},
+			{Name: "actionview", Version: "7.0.4.3", Source: gem},
+			{Name: "nokogiri", Version: "1.15.4", Platform: "x86_64-linux", Source: gem, Dependencies: []GemDependency{{Name: "racc", Requirement: "~> 1.4"}}},
+			{Name: "nokogiri", Version: "1.15.4", Platform: "arm64-darwin", Source: gem, Dependencies: []GemDependency{{Name: "racc", Requirement: "~> 1.4"}}},
+			{Name: "rack", Version: "2.2.7", Source: gem},
+			{Name: "racc", Version: "1.7.1", Source: gem},
+			{Name: "rails", Version: "7.0.4.3", Source: gem},
+		},
+		Dependencies: []GemDependency{
+			{Name: "admin"},
+			{Name: "nokogiri", Requirement: "~> 1.15"},
+			{Name: "rails", Requirement: "~> 7.0.4, >= 7.0.4.3"},
+			{Name: "rails-controller-testing"},
+		},
+		Platforms:   []string{"arm64-darwin", "x86_64-linux"},
+		RubyVersion: "3.2.2p53",
+		BundledWith: "2.4.10",
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"LF", testLockfile},
+		{"CRLF", strings.ReplaceAll(testLockfile, "\n", "\r\n")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repoFolder := t.TempDir()
+			if err := os.WriteFile(filepath.Join(repoFolder, "Gemfile.lock"), []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			lockfile, err := parseLockfile(repoFolder)
+			if err != nil {
+				t.Fatalf("parseLockfile: %v", err)
+			}
+			if !reflect.DeepEqual(lockfile, want) {
+				t.Errorf("parseLockfile =\n%+v\nwant\n%+v", lockfile, want)
+			}
+
+			if gem, found := lockfile.Gem("nokogiri"); !found || gem.Platform != "x86_64-linux" {
+				t.Errorf("Gem(nokogiri) = %+v, %t", gem, found)
+			}
+			if lockfile.HasGem("pg") {
+				t.Error("HasGem(pg) = true")
+			}
+		})
+	}
+}
+
+func TestParseLockfileMissing(t *testing.T) {
+	if _, err := parseLockfile(t.TempDir()); err == nil {
+		t.Error("parseLockfile without a Gemfile.lock succeeded")
+	}
+}
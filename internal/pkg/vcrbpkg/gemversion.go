@@ -0,0 +1,135 @@
+package vcrbpkg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gemVersion is a gem version like 7.0.4.3 or 1.0.0.rc1, compared like
+// Gem::Version: segments are compared in order, letters make a prerelease
+// that is lower than any number.
+type gemVersion []gemVersionSegment
+
+type gemVersionSegment struct {
+	number int64
+	text   string
+}
+
+func (s gemVersionSegment) isText() bool {
+	return s.text != ""
+}
+
+var (
+	gemVersionRegex        = regexp.MustCompile(`^[0-9]+(?:\.[0-9a-zA-Z]+)*(?:-[0-9A-Za-z.-]+)?$`)
+	gemVersionSegmentRegex = regexp.MustCompile(`[0-9]+|[A-Za-z]+`)
+	gemRequirementRegex    = regexp.MustCompile(`^(=|!=|>=|<=|>|<|~>)?\s*(\S+)$`)
+)
+
+// parseGemVersion parses version, a - starts a prerelease like in RubyGems.
+func parseGemVersion(version string) (gemVersion, error) {
+	version = strings.TrimSpace(version)
+	if !gemVersionRegex.MatchString(version) {
+		return nil, fmt.Errorf("invalid gem version '%s'", version)
+	}
+	var parsed gemVersion
+	for _, segment := range gemVersionSegmentRegex.FindAllString(strings.ReplaceAll(version, "-", ".pre."), -1) {
+		if number, err := strconv.ParseInt(segment, 10, 64); err == nil {
+			parsed = append(parsed, gemVersionSegment{number: number})
+		} else {
+			parsed = append(parsed, gemVersionSegment{text: segment})
+		}
+	}
+	return parsed, nil
+}
+
+// compare returns -1, 0 or 1 when v is lower, equal or higher than other.
+func (v gemVersion) compare(other gemVersion) int {
+	length := len(v)
+	if len(other) > length {
+		length = len(other)
+	}
+	for i := 0; i < length; i++ {
+		a, b := gemVersionSegment{}, gemVersionSegment{}
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+		switch {
+		case a.isText() && b.isText():
+			if c := strings.Compare(a.text, b.text); c != 0 {
+				return c
+			}
+		case a.isText():
+			return -1
+		case b.isText():
+			return 1
+		case a.number < b.number:
+			return -1
+		case a.number > b.number:
+			return 1
+		}
+	}
+	return 0
+}
+
+// release returns v without prerelease segments.
+func (v gemVersion) release() gemVersion {
+	for i, segment := range v {
+		if segment.isText() {
+			return v[:i]
+		}
+	}
+	return v
+}
+
+// bump returns the upper bound of ~> v: 1.2.3 becomes 1.3 and 1.2 becomes 2.
+func (v gemVersion) bump() gemVersion {
+	bumped := append(gemVersion{}, v.release()...)
+	if len(bumped) > 1 {
+		bumped = bumped[:len(bumped)-1]
+	}
+	bumped[len(bumped)-1].number++
+	return bumped
+}
+
+// gemRequirementMatches returns whether version meets requirement, a list of
+// comma separated constraints like "~> 5.2.4, >= 5.2.4.3".
+func gemRequirementMatches(requirement string, version gemVersion) (bool, error) {
+	for _, constraint := range strings.Split(requirement, ",") {
+		match := gemRequirementRegex.FindStringSubmatch(strings.TrimSpace(constraint))
+		if match == nil {
+			return false, fmt.Errorf("invalid gem requirement '%s'", requirement)
+		}
+		required, err := parseGemVersion(match[2])
+		if err != nil {
+			return false, err
+		}
+
+		c := version.compare(required)
+		var matches bool
+		switch match[1] {
+		case "", "=":
+			matches = c == 0
+		case "!=":
+			matches = c != 0
+		case ">":
+			matches = c > 0
+		case "<":
+			matches = c < 0
+		case ">=":
+			matches = c >= 0
+		case "<=":
+			matches = c <= 0
+		case "~>":
+			matches = c >= 0 && version.release().compare(required.bump()) < 0
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,119 @@
+package vcrbpkg
+
+import "testing"
+
+func TestGemVersionCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0.0", 0},
+		{"1.2.10", "1.2.9", 1},
+		{"7.0.4.3", "7.0.4", 1},
+		{"1.0.0.rc1", "1.0.0", -1},
+		{"1.0.0.beta", "1.0.0.rc1", -1},
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.0.0.rc1", "1.0.0.rc2", -1},
+	}
+	for _, test := range tests {
+		t.Run(test.a+" "+test.b, func(t *testing.T) {
+			a, err := parseGemVersion(test.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseGemVersion(test.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.compare(b); got != test.want {
+				t.Errorf("compare(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+			}
+			if got := b.compare(a); got != -test.want {
+				t.Errorf("compare(%s, %s) = %d, want %d", test.b, test.a, got, -test.want)
+			}
+		})
+	}
+}
+
+func TestParseGemVersionInvalid(t *testing.T) {
+	for _, version := range []string{"", "abc", "1..2", "1.0 2.0", ">= 1.0"} {
+		if _, err := parseGemVersion(version); err == nil {
+			t.Errorf("parseGemVersion(%q) succeeded", version)
+		}
+	}
+}
+
+func TestGemRequirementMatches(t *testing.T) {
+	tests := []struct {
+		requirement string
+		version     string
+		want        bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"= 1.2.3", "1.2.3", true},
+		{"= 1.2", "1.2.0", true},
+		{"= 1.2.3", "1.2.4", false},
+		{"!= 1.2.3", "1.2.3", false},
+		{"!= 1.2.3", "1.2.4", true},
+		{"> 1.2.3", "1.2.3", false},
+		{"> 1.2.3", "1.2.3.1", true},
+		{"< 1.2.3", "1.2.3", false},
+		{"< 1.2.3", "1.2.2", true},
+		{">= 1.2.3", "1.2.3", true},
+		{">= 1.2.3", "1.2.2", false},
+		{"<= 1.2.3", "1.2.3", true},
+		{"<= 1.2.3", "1.2.4", false},
+		{">=1.2.3", "1.2.3", true},
+
+		// ~> 5.2.4 is >= 5.2.4 and < 5.3, ~> 5.2 is >= 5.2 and < 6
+		{"~> 5.2.4", "5.2.4", true},
+		{"~> 5.2.4", "5.2.4.3", true},
+		{"~> 5.2.4", "5.2.10", true},
+		{"~> 5.2.4", "5.3.0", false},
+		{"~> 5.2.4", "5.2.3", false},
+		{"~> 5.2", "5.9.1", true},
+		{"~> 5.2", "6.0", false},
+		{"~> 5", "5.99", true},
+		{"~> 5", "6.0", false},
+		{"~> 1.0.0.rc1", "1.0.0", true},
+		{"~> 1.0.0.rc1", "1.0.0.rc2", true},
+		{"~> 1.0.0.rc1", "1.1.0", false},
+
+		{"~> 5.2.4, >= 5.2.4.3", "5.2.4.3", true},
+		{"~> 5.2.4, >= 5.2.4.3", "5.2.4.2", false},
+		{">= 2.2.4, < 4", "3.0.8", true},
+		{">= 2.2.4, < 4", "4.0.0", false},
+
+		// Prereleases are lower than the release
+		{"< 1.0.0", "1.0.0.rc1", true},
+		{">= 1.0.0", "1.0.0.rc1", false},
+		{">= 1.0.0.rc1", "1.0.0.beta2", false},
+	}
+	for _, test := range tests {
+		t.Run(test.requirement+" "+test.version, func(t *testing.T) {
+			version, err := parseGemVersion(test.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gemRequirementMatches(test.requirement, version)
+			if err != nil {
+				t.Fatalf("gemRequirementMatches(%q, %s): %v", test.requirement, test.version, err)
+			}
+			if got != test.want {
+				t.Errorf("gemRequirementMatches(%q, %s) = %t, want %t", test.requirement, test.version, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGemRequirementMatchesInvalid(t *testing.T) {
+	version, err := parseGemVersion("1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, requirement := range []string{"", "=> 1.0", "~> 1.0 2.0", ">= abc", ">= 1.0,", "^1.0"} {
+		if _, err := gemRequirementMatches(requirement, version); err == nil {
+			t.Errorf("gemRequirementMatches(%q) succeeded", requirement)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package vcrbpkg
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// PackageInfo describes a package produced by veracode prepare.
+type PackageInfo struct {
+	File             string          `json:"file"`
+	Size             int64           `json:"size"`
+	UncompressedSize uint64          `json:"uncompressed_size"`
+	Entries          int             `json:"entries"`
+	Metadata         PackageMetadata `json:"metadata"`
+	// InstructionSequences compiled from CompiledFiles source files.
+	InstructionSequences int               `json:"instruction_sequences"`
+	CompiledFiles        int               `json:"compiled_files"`
+	Directories          []DirectoryISeqs  `json:"directories"`
+	Largest              []PackageEntry    `json:"largest"`
+	Unexpected           []UnexpectedEntry `json:"unexpected,omitempty"`
+	files                map[string]*zip.File
+	compiled             map[string]int
+	// disasm are the entries with instruction sequences and root the guessed
+	// root of the application in their paths.
+	disasm map[string]bool
+	root   string
+}
+
+// PackageMetadata is what the package tells about how it was made. It is
+// recognized loosely, as the layout differs between versions of the veracode
+// gem.
+type PackageMetadata struct {
+	RubyVersion     string   `json:"ruby_version,omitempty"`
+	RailsVersion    string   `json:"rails_version,omitempty"`
+	RailsEnv        string   `json:"rails_env,omitempty"`
+	VeracodeVersion string   `json:"veracode_version,omitempty"`
+	Files           []string `json:"files,omitempty"`
+}
+
+// DirectoryISeqs are the instruction sequences compiled from the source files
+// in a directory, like app/models.
+type DirectoryISeqs struct {
+	Directory            string `json:"directory"`
+	Files                int    `json:"files"`
+	InstructionSequences int    `json:"instruction_sequences"`
+}
+
+// PackageEntry is a file in the package.
+type PackageEntry struct {
+	Name           string `json:"name"`
+	Size           uint64 `json:"size"`
+	CompressedSize uint64 `json:"compressed_size"`
+}
+
+// UnexpectedEntry is a file that should not be in a package.
+type UnexpectedEntry struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// junkPattern matches files that should not be in a package.
+type junkPattern struct {
+	re     *regexp.Regexp
+	reason string
+}
+
+var junkPatterns = []junkPattern{
+	{regexp.MustCompile(`(^|/)\.git/`), "git repository"},
+	{regexp.MustCompile(`(^|/)node_modules/`), "node modules"},
+	{regexp.MustCompile(`(^|/)log/[^/]+\.log$`), "log file"},
+	{regexp.MustCompile(`(^|/)tmp/`), "temporary file"},
+	{regexp.MustCompile(`(^|/)coverage/`), "test coverage report"},
+	{regexp.MustCompile(`(^|/)\.env(\.[^/]*)?$`), "environment file, may contain secrets"},
+	{regexp.MustCompile(`(^|/)config/master\.key$|\.pem$|(^|/)id_(rsa|ecdsa|ed25519)$`), "private key"},
+	{regexp.MustCompile(`\.sqlite3?$`), "database"},
+	{regexp.MustCompile(`\.(zip|tar|tgz|gz)$`), "archive"},
+}
+
+// maxLargestEntries is how many of the largest entries are listed.
+const maxLargestEntries = 10
+
+// The header of RubyVM::InstructionSequence#disasm, for example
+// "== disasm: #<ISeq:<main>@/app/app/models/user.rb:1 (1,0)-(10,3)>".
+var disasmRegex = regexp.MustCompile(`^== disasm: #?<(?:ISeq|RubyVM::InstructionSequence):.*?@([^:>\s]+)`)
+
+var (
+	metadataRubyRegex     = regexp.MustCompile(`(?i)(?:RUBY_VERSION\W+|\bruby\s+)(\d+\.\d+\.\d+)`)
+	metadataRailsRegex    = regexp.MustCompile(`(?m)(?:^\s{4}rails \(|Rails(?:\.version|_VERSION| version)\W+)(\d+\.\d+[.\w]*)`)
+	metadataRailsEnvRegex = regexp.MustCompile(`(?:RAILS_ENV|Rails\.env)\W+([A-Za-z0-9_-]+)`)
+	metadataVeracodeRegex = regexp.MustCompile(`(?i)(?:^\s{4}veracode \(|veracode(?: gem)? (?:version )?v?)(\d+\.\d+\.\d+)`)
+)
+
+// maxMetadataSize is the largest text file read for metadata.
+const maxMetadataSize = 1 << 20
+
+// InspectPackage reads the package at file.
+func InspectPackage(file string) (*PackageInfo, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to open package %s", file)
+		return nil, fmt.Errorf("unable to open package %s", file)
+	}
+	reader, err := zip.OpenReader(file)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to open package %s as zip", file)
+		return nil, fmt.Errorf("unable to open package %s as zip: %v", file, err)
+	}
+	defer reader.Close()
+
+	info := &PackageInfo{
+		File:     file,
+		Size:     stat.Size(),
+		files:    map[string]*zip.File{},
+		compiled: map[string]int{},
+		disasm:   map[string]bool{},
+	}
+	var entries []PackageEntry
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		info.Entries++
+		info.UncompressedSize += f.UncompressedSize64
+		info.files[f.Name] = f
+		entries = append(entries, PackageEntry{Name: f.Name, Size: f.UncompressedSize64, CompressedSize: f.CompressedSize64})
+
+		for _, junk := range junkPatterns {
+			if junk.re.MatchString(f.Name) {
+				info.Unexpected = append(info.Unexpected, UnexpectedEntry{Name: f.Name, Reason: junk.reason})
+				break
+			}
+		}
+
+		if isTextEntry(f.Name) {
+			if err := info.readTextEntry(f); err != nil {
+				logger.WithError(err).Errorf("Unable to read %s in package %s", f.Name, file)
+				return nil, fmt.Errorf("unable to read %s in package %s: %v", f.Name, file, err)
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Size > entries[j].Size })
+	if len(entries) > maxLargestEntries {
+		entries = entries[:maxLargestEntries]
+	}
+	info.Largest = entries
+	info.summarizeCompiled()
+	return info, nil
+}
+
+// isTextEntry returns whether the entry may hold disassembly or metadata, the
+// sources in the package are not interesting.
+func isTextEntry(name string) bool {
+	switch path.Ext(name) {
+	case ".txt", ".json", ".yml", ".yaml", ".log", ".lock", "":
+		return true
+	}
+	return false
+}
+
+func (info *PackageInfo) readTextEntry(f *zip.File) error {
+	reader, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	isMetadata := false
+	var head strings.Builder
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := disasmRegex.FindStringSubmatch(line); match != nil {
+			info.InstructionSequences++
+			info.compiled[match[1]]++
+			info.disasm[f.Name] = true
+			continue
+		}
+		if f.UncompressedSize64 <= maxMetadataSize {
+			head.WriteString(line)
+			head.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	text := head.String()
+	for _, field := range []struct {
+		value *string
+		re    *regexp.Regexp
+	}{
+		{&info.Metadata.RubyVersion, metadataRubyRegex},
+		{&info.Metadata.RailsVersion, metadataRailsRegex},
+		{&info.Metadata.RailsEnv, metadataRailsEnvRegex},
+		{&info.Metadata.VeracodeVersion, metadataVeracodeRegex},
+	} {
+		if match := field.re.FindStringSubmatch(text); match != nil {
+			isMetadata = true
+			if *field.value == "" {
+				*field.value = match[1]
+			}
+		}
+	}
+	if isMetadata {
+		info.Metadata.Files = append(info.Metadata.Files, f.Name)
+	}
+	return nil
+}
+
+// summarizeCompiled groups the compiled source files by directory. The paths
+// are those of the machine that ran veracode prepare, so they are made
+// relative to the common root of the application files, gems are grouped
+// together.
+func (info *PackageInfo) summarizeCompiled() {
+	var appFiles []string
+	for file := range info.compiled {
+		if !isGemPath(file) {
+			appFiles = append(appFiles, file)
+		}
+	}
+	root := appRoot(appFiles)
+	info.root = root
+
+	directories := map[string]*DirectoryISeqs{}
+	for file, iseqs := range info.compiled {
+		directory := "gems"
+		if !isGemPath(file) {
+			directory = coverageDirectory(strings.TrimPrefix(strings.TrimPrefix(file, root), "/"))
+		}
+		if directories[directory] == nil {
+			directories[directory] = &DirectoryISeqs{Directory: directory}
+		}
+		directories[directory].Files++
+		directories[directory].InstructionSequences += iseqs
+	}
+
+	info.CompiledFiles = len(info.compiled)
+	info.Directories = []DirectoryISeqs{}
+	for _, directory := range directories {
+		info.Directories = append(info.Directories, *directory)
+	}
+	sort.Slice(info.Directories, func(i, j int) bool {
+		return info.Directories[i].Directory < info.Directories[j].Directory
+	})
+}
+
+func isGemPath(file string) bool {
+	return strings.Contains(file, "/gems/") || strings.Contains(file, "/rubies/")
+}
+
+// railsTopDirs are the directories in the root of a Rails application.
+var railsTopDirs = map[string]bool{"app": true, "lib": true, "config": true, "db": true, "vendor": true}
+
+// appRoot guesses the root of the application the files are in. That is their
+// common directory, unless all of them are in a single directory of the
+// application, like /src/app/models for /src/app/models/*.rb.
+func appRoot(files []string) string {
+	root := commonDir(files)
+	for _, file := range files {
+		first, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(file, root), "/"), "/")
+		if railsTopDirs[first] {
+			return root
+		}
+	}
+
+	parts := strings.Split(root, "/")
+	for i := len(parts) - 1; i > 0; i-- {
+		if railsTopDirs[parts[i]] {
+			return strings.Join(parts[:i], "/")
+		}
+	}
+	return root
+}
+
+// commonDir returns the longest directory all files are in.
+func commonDir(files []string) string {
+	if len(files) == 0 {
+		return ""
+	}
+	common := path.Dir(files[0])
+	for _, file := range files[1:] {
+		for common != "/" && common != "." && !strings.HasPrefix(file, common+"/") {
+			common = path.Dir(common)
+		}
+	}
+	if common == "/" || common == "." {
+		return ""
+	}
+	return common
+}
+
+// Output formats of the package subcommands.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Inspect prints what is in the package in args, as text or JSON.
+func Inspect(args []string, format string) error {
+	info, err := InspectPackage(args[0])
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatJSON:
+		return printJSON(info)
+	case FormatText:
+		printPackageInfo(info)
+		return nil
+	default:
+		return fmt.Errorf("invalid format '%s', expected %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+func printJSON(value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode JSON: %v", err)
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(content))
+	return err
+}
+
+func printPackageInfo(info *PackageInfo) {
+	w := os.Stdout
+	fmt.Fprintf(w, "Package:   %s\n", info.File)
+	fmt.Fprintf(w, "Size:      %s (%s uncompressed, %d files)\n", humanSize(uint64(info.Size)), humanSize(info.UncompressedSize), info.Entries)
+	fmt.Fprintf(w, "Ruby:      %s\n", orUnknown(info.Metadata.RubyVersion))
+	fmt.Fprintf(w, "Rails:     %s\n", orUnknown(info.Metadata.RailsVersion))
+	fmt.Fprintf(w, "Rails env: %s\n", orUnknown(info.Metadata.RailsEnv))
+	fmt.Fprintf(w, "Veracode:  %s\n", orUnknown(info.Metadata.VeracodeVersion))
+	if len(info.Metadata.Files) > 0 {
+		fmt.Fprintf(w, "Metadata:  %s\n", strings.Join(info.Metadata.Files, ", "))
+	}
+
+	fmt.Fprintf(w, "\nCompiled %d instruction sequences from %d files:\n", info.InstructionSequences, info.CompiledFiles)
+	for _, directory := range info.Directories {
+		fmt.Fprintf(w, "    %-30s %6d iseqs in %4d files\n", directory.Directory, directory.InstructionSequences, directory.Files)
+	}
+
+	fmt.Fprintln(w, "\nLargest entries:")
+	for _, entry := range info.Largest {
+		fmt.Fprintf(w, "    %10s  %s\n", humanSize(entry.Size), entry.Name)
+	}
+
+	if len(info.Unexpected) > 0 {
+		fmt.Fprintln(w, "\nUnexpected files:")
+		for _, entry := range info.Unexpected {
+			fmt.Fprintf(w, "    %s (%s)\n", entry.Name, entry.Reason)
+		}
+	}
+}
+
+// humanSize formats a number of bytes like 1.5 MiB.
+func humanSize(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
@@ -0,0 +1,180 @@
+package vcrbpkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Limits on the resources used by the commands that run application code:
+// bundle install, rails server and veracode prepare. Zero means no limit.
+type Limits struct {
+	// Memory is the maximum memory of all processes of a command together
+	// with cgroup v2, or of each process (address space) with rlimits.
+	Memory ByteSize
+	// CPUTime is the maximum CPU time of each process.
+	CPUTime time.Duration
+	// Processes is the maximum number of processes of a command with
+	// cgroup v2, or of our user with rlimits.
+	Processes int
+}
+
+func (l Limits) enabled() bool {
+	return l.Memory > 0 || l.CPUTime > 0 || l.Processes > 0
+}
+
+// Names of the limits, as used in the configuration file.
+const (
+	limitStepTimeout  = "step_timeout"
+	limitMaxMemory    = "max_memory"
+	limitMaxCPUTime   = "max_cpu_time"
+	limitMaxProcesses = "max_processes"
+)
+
+// ExitLimitExceeded is the exit code when the run failed because a command
+// was stopped for exceeding a limit.
+const ExitLimitExceeded = 9
+
+// LimitExceededError is returned when a command was stopped because it
+// exceeded one of the configured limits, as opposed to failing by itself.
+type LimitExceededError struct {
+	Step  string `json:"step"`
+	Limit string `json:"limit"`
+	// Value of the limit that was exceeded.
+	Value string `json:"value"`
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s exceeded %s of %s", e.Step, e.Limit, e.Value)
+}
+
+// ExitCode makes vcrbpkg exit with ExitLimitExceeded.
+func (e *LimitExceededError) ExitCode() int {
+	return ExitLimitExceeded
+}
+
+// ByteSize is an amount of memory, configured like 512M or 2G.
+type ByteSize uint64
+
+var byteSizeRegex = regexp.MustCompile(`^(\d+)\s*([KMGT]?)(?:I?B)?$`)
+
+var byteSizeUnits = map[string]uint{"": 0, "K": 10, "M": 20, "G": 30, "T": 40}
+
+// ParseByteSize parses a size like 512M, 2G or 2GiB.
+func ParseByteSize(value string) (ByteSize, error) {
+	match := byteSizeRegex.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size '%s', expected a size like 512M or 2G", value)
+	}
+	size, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s', expected a size like 512M or 2G", value)
+	}
+	return ByteSize(size << byteSizeUnits[match[2]]), nil
+}
+
+func (s ByteSize) String() string {
+	for _, unit := range []string{"T", "G", "M", "K"} {
+		shift := byteSizeUnits[unit]
+		if s >= 1<<shift && s%(1<<shift) == 0 {
+			return fmt.Sprintf("%d%s", s>>shift, unit)
+		}
+	}
+	return strconv.FormatUint(uint64(s), 10)
+}
+
+// UnmarshalYAML accepts both a number of bytes and a size like 2G.
+func (s *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// Output of processes stopped by rlimits, which we can only recognize by what
+// Ruby or the shell prints.
+var (
+	rlimitMemoryRegex    = regexp.MustCompile(`failed to allocate memory|Cannot allocate memory`)
+	rlimitProcessesRegex = regexp.MustCompile(`Resource temporarily unavailable - fork|fork: retry: Resource temporarily unavailable|fork: Resource temporarily unavailable`)
+)
+
+// runLimited runs cmd for step like runCommand, in the sandbox configured in
+// opts and stopping it after timeout if set. When the command is stopped
+// because it exceeded a limit a *LimitExceededError is returned.
+func runLimited(ctx context.Context, cmd *exec.Cmd, step string, opts Options, timeout time.Duration) error {
+	logEnv(step, cmd.Env)
+
+	sb, err := applySandbox(cmd, step, opts)
+	if err != nil {
+		return err
+	}
+	defer sb.close()
+
+	// Keep the output to recognize limits enforced with rlimits
+	var output bytes.Buffer
+	if sb.usesRlimits() {
+		tee := &teeWriter{w: cmd.Stdout, output: &output}
+		if cmd.Stderr == cmd.Stdout {
+			cmd.Stderr = tee
+		}
+		cmd.Stdout = tee
+	}
+
+	stepCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err = runCommand(stepCtx, cmd)
+	if ctx.Err() != nil {
+		return err
+	}
+	if timeout > 0 && stepCtx.Err() == context.DeadlineExceeded {
+		return &LimitExceededError{Step: step, Limit: limitStepTimeout, Value: timeout.String()}
+	}
+	if err == nil {
+		return nil
+	}
+	if limit, value := sb.exceeded(err, output.Bytes()); limit != "" {
+		return &LimitExceededError{Step: step, Limit: limit, Value: value}
+	}
+	return err
+}
+
+// teeWriter writes to w (if set) and keeps a copy in output.
+type teeWriter struct {
+	w      io.Writer
+	output *bytes.Buffer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	t.output.Write(p)
+	if t.w == nil {
+		return len(p), nil
+	}
+	return t.w.Write(p)
+}
+
+// failedOutcome returns the outcome of a step that failed with err, recording
+// it in the report when a limit was exceeded.
+func (r *Report) failedOutcome(err error) string {
+	var limitErr *LimitExceededError
+	if errors.As(err, &limitErr) {
+		r.LimitsExceeded = append(r.LimitsExceeded, limitErr)
+		return outcomeLimitExceeded
+	}
+	return outcomeFailed
+}
@@ -0,0 +1,244 @@
+package vcrbpkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// From linux/resource.h, missing in syscall
+const rlimitNproc = 6
+
+var (
+	cgroupOnce    sync.Once
+	cgroupBaseDir string
+	cgroupBaseErr error
+	cgroupCounter int64
+)
+
+// cgroupBase returns the cgroup v2 directory in which we create a cgroup with
+// the memory and pids controllers for every command.
+func cgroupBase() (string, error) {
+	cgroupOnce.Do(func() {
+		cgroupBaseDir, cgroupBaseErr = findCgroupBase()
+	})
+	return cgroupBaseDir, cgroupBaseErr
+}
+
+// findCgroupBase returns our own cgroup if the memory and pids controllers are
+// enabled for its children, like in a cgroup delegated to us. We only create
+// and remove the cgroups of the commands in it, enabling the controllers
+// ourselves would change the cgroup tree of the host for good.
+func findCgroupBase() (string, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(mount, own)
+
+	if !hasControllers(filepath.Join(dir, "cgroup.subtree_control")) {
+		return "", fmt.Errorf("the memory and pids controllers are not enabled for the children of %s", dir)
+	}
+	return dir, nil
+}
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted.
+func cgroup2Mount() (string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The filesystem type follows the " - " separator
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+// ownCgroup returns the cgroup v2 path of our process.
+func ownCgroup() (string, error) {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 hierarchy")
+}
+
+func hasControllers(file string) bool {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	controllers := strings.Fields(string(content))
+	return contains(controllers, "memory") && contains(controllers, "pids")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCgroupFile(dir string, name string, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+// createCgroup creates a cgroup with the memory and process limits for a
+// single command.
+func createCgroup(limits Limits) (string, error) {
+	base, err := cgroupBase()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(base, fmt.Sprintf("vcrbpkg-%d-%d", os.Getpid(), atomic.AddInt64(&cgroupCounter, 1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		logger.WithError(err).Warnf("Unable to create cgroup %s, using rlimits instead", dir)
+		return "", err
+	}
+
+	if limits.Memory > 0 {
+		err = writeCgroupFile(dir, "memory.max", strconv.FormatUint(uint64(limits.Memory), 10))
+		// Do not let the memory limit be avoided by swapping, if there is swap
+		_ = writeCgroupFile(dir, "memory.swap.max", "0")
+	}
+	if err == nil && limits.Processes > 0 {
+		err = writeCgroupFile(dir, "pids.max", strconv.Itoa(limits.Processes))
+	}
+	if err != nil {
+		logger.WithError(err).Warnf("Unable to set limits in cgroup %s, using rlimits instead", dir)
+		removeCgroup(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// joinCgroup moves our process, the sandbox helper, into the cgroup of the
+// command. The command executed afterwards and everything it starts stays
+// in it.
+func joinCgroup(dir string) error {
+	if err := writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return fmt.Errorf("unable to join cgroup %s: %v", dir, err)
+	}
+	return nil
+}
+
+// removeCgroup kills whatever is left in the cgroup, including processes that
+// left our process group, and removes it.
+func removeCgroup(dir string) {
+	if err := writeCgroupFile(dir, "cgroup.kill", "1"); err != nil {
+		// cgroup.kill needs Linux 5.14
+		procs, _ := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+		for _, pid := range strings.Fields(string(procs)) {
+			if pid, err := strconv.Atoi(pid); err == nil {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+
+	// Removing fails until the killed processes are gone
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	logger.WithError(err).Warnf("Unable to remove cgroup %s", dir)
+}
+
+// cgroupLimitsHit returns whether processes in the cgroup were killed for
+// using too much memory and whether starting processes failed because of
+// the process limit.
+func cgroupLimitsHit(dir string) (memory bool, processes bool) {
+	return cgroupEvents(dir, "memory.events", "oom_kill") > 0, cgroupEvents(dir, "pids.events", "max") > 0
+}
+
+func cgroupEvents(dir string, file string, event string) int {
+	content, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == event {
+			count, _ := strconv.Atoi(fields[1])
+			return count
+		}
+	}
+	return 0
+}
+
+// setRlimits sets the limits for our process, inherited by the command and
+// everything it starts.
+func setRlimits(limits Limits) error {
+	if limits.Memory > 0 {
+		rlimit := syscall.Rlimit{Cur: uint64(limits.Memory), Max: uint64(limits.Memory)}
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &rlimit); err != nil {
+			return fmt.Errorf("unable to limit memory: %v", err)
+		}
+	}
+	if limits.CPUTime > 0 {
+		// Processes get SIGXCPU at the limit and are killed a little later
+		seconds := uint64((limits.CPUTime + time.Second - 1) / time.Second)
+		rlimit := syscall.Rlimit{Cur: seconds, Max: seconds + uint64(killGracePeriod/time.Second)}
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &rlimit); err != nil {
+			return fmt.Errorf("unable to limit CPU time: %v", err)
+		}
+	}
+	if limits.Processes > 0 {
+		rlimit := syscall.Rlimit{Cur: uint64(limits.Processes), Max: uint64(limits.Processes)}
+		if err := syscall.Setrlimit(rlimitNproc, &rlimit); err != nil {
+			return fmt.Errorf("unable to limit processes: %v", err)
+		}
+	}
+	return nil
+}
+
+// killedByCPULimit returns whether the command failing with err was killed by
+// the CPU time limit, directly or as the exit code of the rvm shell.
+func killedByCPULimit(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+	if status.Signaled() {
+		return status.Signal() == syscall.SIGXCPU
+	}
+	return status.ExitStatus() == 128+int(syscall.SIGXCPU)
+}
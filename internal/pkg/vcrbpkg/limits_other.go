@@ -0,0 +1,21 @@
+//go:build !linux
+
+package vcrbpkg
+
+func cgroupBase() (string, error) {
+	return "", errSandboxUnsupported
+}
+
+func createCgroup(limits Limits) (string, error) {
+	return "", errSandboxUnsupported
+}
+
+func removeCgroup(dir string) {}
+
+func cgroupLimitsHit(dir string) (memory bool, processes bool) {
+	return false, false
+}
+
+func killedByCPULimit(err error) bool {
+	return false
+}
@@ -0,0 +1,336 @@
+package vcrbpkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// ExitVerificationFailed is the exit code of verify when the package does not
+// match its manifest or signature.
+const ExitVerificationFailed = 7
+
+// Manifest describes where an exported package came from, written next to it
+// as <name>.manifest.json.
+type Manifest struct {
+	Package string `json:"package"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	// Source is the repository URL, without credentials.
+	Source          string    `json:"source,omitempty"`
+	Commit          string    `json:"commit,omitempty"`
+	RubyVersion     string    `json:"ruby_version,omitempty"`
+	RailsVersion    string    `json:"rails_version,omitempty"`
+	RailsEnv        string    `json:"rails_env,omitempty"`
+	VcrbpkgVersion  string    `json:"vcrbpkg_version"`
+	VeracodeVersion string    `json:"veracode_version,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	// SBOM is the file name of the SBOM next to the package, if written.
+	SBOM       string `json:"sbom,omitempty"`
+	SBOMSHA256 string `json:"sbom_sha256,omitempty"`
+}
+
+// Export is what was written when exporting the package.
+type Export struct {
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+	// ChecksumFile and ManifestFile are not written when streaming to stdout.
+	ChecksumFile string `json:"checksum_file,omitempty"`
+	ManifestFile string `json:"manifest_file,omitempty"`
+	// SignatureFile of the manifest, if signed.
+	SignatureFile string `json:"signature_file,omitempty"`
+	// SBOMFile is the CycloneDX SBOM of the gems, if written.
+	SBOMFile string `json:"sbom_file,omitempty"`
+}
+
+// manifestFile returns the manifest next to the package, like
+// railsgoat.manifest.json for railsgoat.zip.
+func manifestFile(packageFile string) string {
+	return strings.TrimSuffix(packageFile, filepath.Ext(packageFile)) + ".manifest.json"
+}
+
+// checksumFile returns the sha256sum compatible checksum file of the package.
+func checksumFile(packageFile string) string {
+	return packageFile + ".sha256"
+}
+
+// sha256File returns the hex SHA-256 and size of file.
+func sha256File(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// exportPackage copies the package to opts.OutFile and writes its checksum,
+// the sbom if set and the manifest next to it, signing the manifest with
+// signer if set. With stdoutFile as opts.OutFile the package is streamed to
+// stdout instead.
+func exportPackage(ctx context.Context, input string, repoFolder string, packagedFile string, sbom []byte, opts Options, signer *signingKey, report *Report) error {
+	if opts.OutFile == stdoutFile {
+		return streamPackage(packagedFile, report)
+	}
+
+	manifest := newManifest(ctx, input, repoFolder, report)
+	outFile, err := resolveOutFile(opts.OutFile, newOutName(input, repoFolder, manifest))
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to determine the file to export to for %s", opts.OutFile)
+		return fmt.Errorf("unable to determine the file to export to for %s", opts.OutFile)
+	}
+	// Fail before writing anything, writing each file fails too if it was
+	// created in the meantime
+	for _, file := range exportFiles(outFile, opts, signer) {
+		if err := checkOverwrite(file, opts.Force); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(outFile), 0755); err != nil {
+		logger.WithError(err).Errorf("Unable to create directory for %s", outFile)
+		return fmt.Errorf("unable to create directory for %s", outFile)
+	}
+	if err := copyFile(packagedFile, outFile, opts.Force); err != nil {
+		return err
+	}
+
+	checksum, size, err := sha256File(outFile)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to compute checksum of %s", outFile)
+		return fmt.Errorf("unable to compute checksum of %s", outFile)
+	}
+	export := &Export{File: outFile, SHA256: checksum, ChecksumFile: checksumFile(outFile), ManifestFile: manifestFile(outFile)}
+	report.Export = export
+
+	// In the format of sha256sum, so sha256sum -c can check it
+	checksumLine := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(outFile))
+	if err := writeSidecar(export.ChecksumFile, []byte(checksumLine), opts.Force); err != nil {
+		return err
+	}
+
+	if sbom != nil {
+		export.SBOMFile = sbomFile(outFile)
+		if err := writeSidecar(export.SBOMFile, sbom, opts.Force); err != nil {
+			return err
+		}
+		sbomChecksum := sha256.Sum256(sbom)
+		manifest.SBOM = filepath.Base(export.SBOMFile)
+		manifest.SBOMSHA256 = hex.EncodeToString(sbomChecksum[:])
+		logger.Infof("Wrote SBOM to %s", export.SBOMFile)
+	}
+
+	manifest.Package = filepath.Base(outFile)
+	manifest.Size = size
+	manifest.SHA256 = checksum
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode manifest: %v", err)
+	}
+	content = append(content, '\n')
+	if err := writeSidecar(export.ManifestFile, content, opts.Force); err != nil {
+		return err
+	}
+
+	if signer != nil {
+		export.SignatureFile = export.ManifestFile + signatureExtensions[signer.format]
+		if err := writeSidecar(export.SignatureFile, signer.sign(content, filepath.Base(export.ManifestFile)), opts.Force); err != nil {
+			return err
+		}
+		logger.Infof("Signed manifest with %s key %s", signer.format, opts.SignKey)
+	}
+
+	logger.Infof("Exported %s (sha256 %s) with manifest %s", outFile, checksum, export.ManifestFile)
+	return nil
+}
+
+// verifySBOM checks the SBOM in the manifest matches its checksum, if it is
+// next to the manifest. Without it only the package can be verified.
+func verifySBOM(packageFile string, manifestPath string, manifest *Manifest) error {
+	if manifest.SBOM == "" {
+		return nil
+	}
+	file := filepath.Join(filepath.Dir(manifestPath), filepath.Base(manifest.SBOM))
+	checksum, _, err := sha256File(file)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Warnf("SBOM %s of the manifest not found, not checking it", file)
+		return nil
+	}
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to read SBOM %s", file)
+		return fmt.Errorf("unable to read SBOM %s", file)
+	}
+	if checksum != manifest.SBOMSHA256 {
+		return &VerificationError{File: packageFile, Reason: fmt.Sprintf("SBOM %s sha256 %s does not match %s in the manifest", file, checksum, manifest.SBOMSHA256)}
+	}
+	logger.Infof("SBOM %s matches manifest %s", file, manifestPath)
+	return nil
+}
+
+// streamPackage writes the package to stdout, logging its checksum as there
+// is nowhere to write the checksum and manifest to.
+func streamPackage(packagedFile string, report *Report) error {
+	src, err := os.Open(packagedFile)
+	if err != nil {
+		logger.WithError(err).Errorf("Error opening source file %s", packagedFile)
+		return fmt.Errorf("error opening source file: %v", err)
+	}
+	defer src.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(os.Stdout, hash), src); err != nil {
+		logger.WithError(err).Errorf("Unable to write %s to stdout", packagedFile)
+		return fmt.Errorf("unable to write %s to stdout", packagedFile)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	report.Export = &Export{File: stdoutFile, SHA256: checksum}
+
+	logger.Infof("Streamed %s to stdout (sha256 %s)", packagedFile, checksum)
+	return nil
+}
+
+func writeSidecar(file string, content []byte, force bool) error {
+	return writeOutFile(file, force, func(w io.Writer) error {
+		if _, err := w.Write(content); err != nil {
+			logger.WithError(err).Errorf("Unable to write %s", file)
+			return fmt.Errorf("unable to write %s", file)
+		}
+		return nil
+	})
+}
+
+// newManifest collects the provenance of the package from the run, the git
+// checkout, Gemfile.lock and the package.
+func newManifest(ctx context.Context, input string, repoFolder string, report *Report) *Manifest {
+	manifest := &Manifest{
+		RubyVersion:    report.RubyVersion,
+		RailsEnv:       report.RailsEnv,
+		VcrbpkgVersion: BuildVersion(),
+		CreatedAt:      time.Now().UTC().Truncate(time.Second),
+	}
+
+	if repoFolder == input {
+		if output, err := outputCommand(ctx, exec.Command("git", "-C", repoFolder, "remote", "get-url", "origin")); err == nil {
+			manifest.Source = strings.TrimSpace(string(output))
+		}
+	} else {
+		manifest.Source = input
+	}
+	manifest.Source = urlCredentialsRegex.ReplaceAllString(manifest.Source, "://")
+	manifest.Commit = gitCommit(ctx, repoFolder)
+
+	if lockfile, err := parseLockfile(repoFolder); err == nil {
+		if gem, found := lockfile.Gem("rails"); found {
+			manifest.RailsVersion = gem.Version
+		} else if gem, found := lockfile.Gem("railties"); found {
+			manifest.RailsVersion = gem.Version
+		}
+		if gem, found := lockfile.Gem("veracode"); found {
+			manifest.VeracodeVersion = gem.Version
+		}
+	}
+	if manifest.RailsVersion == "" || manifest.VeracodeVersion == "" {
+		if info, err := InspectPackage(report.PackagedFile); err == nil {
+			if manifest.RailsVersion == "" {
+				manifest.RailsVersion = info.Metadata.RailsVersion
+			}
+			if manifest.VeracodeVersion == "" {
+				manifest.VeracodeVersion = info.Metadata.VeracodeVersion
+			}
+		}
+	}
+	return manifest
+}
+
+// VerificationError is returned when a package does not match its manifest or
+// signature.
+type VerificationError struct {
+	File   string
+	Reason string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("verification of %s failed: %s", e.File, e.Reason)
+}
+
+// ExitCode makes vcrbpkg exit with ExitVerificationFailed.
+func (e *VerificationError) ExitCode() int {
+	return ExitVerificationFailed
+}
+
+// Verify checks the package in args matches the checksum in its manifest
+// and, with a public key, that the manifest is signed with that key.
+// manifestPath defaults to the manifest next to the package.
+func Verify(args []string, manifestPath string, publicKey string) error {
+	packageFile := args[0]
+	if manifestPath == "" {
+		manifestPath = manifestFile(packageFile)
+	}
+
+	content, err := os.ReadFile(manifestPath)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to read manifest %s", manifestPath)
+		return fmt.Errorf("unable to read manifest %s", manifestPath)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return &VerificationError{File: packageFile, Reason: fmt.Sprintf("invalid manifest %s: %v", manifestPath, err)}
+	}
+
+	if publicKey != "" {
+		key, err := loadVerifyingKey(publicKey)
+		if err != nil {
+			return err
+		}
+		signatureFile := manifestPath + signatureExtensions[key.format]
+		signature, err := os.ReadFile(signatureFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return &VerificationError{File: packageFile, Reason: fmt.Sprintf("manifest is not signed, %s not found", signatureFile)}
+		}
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to read signature %s", signatureFile)
+			return fmt.Errorf("unable to read signature %s", signatureFile)
+		}
+		if err := key.verify(content, signature); err != nil {
+			return &VerificationError{File: packageFile, Reason: fmt.Sprintf("manifest signature %s: %v", signatureFile, err)}
+		}
+		logger.Infof("Manifest %s is signed with %s", manifestPath, publicKey)
+	}
+
+	checksum, size, err := sha256File(packageFile)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to read package %s", packageFile)
+		return fmt.Errorf("unable to read package %s", packageFile)
+	}
+	if size != manifest.Size || checksum != manifest.SHA256 {
+		return &VerificationError{File: packageFile, Reason: fmt.Sprintf("sha256 %s does not match %s in the manifest", checksum, manifest.SHA256)}
+	}
+
+	logger.Infof("Package %s matches manifest %s (sha256 %s)", packageFile, manifestPath, checksum)
+	if err := verifySBOM(packageFile, manifestPath, &manifest); err != nil {
+		return err
+	}
+	if manifest.Source != "" {
+		logger.Infof("Built from %s %s in %s on %s", manifest.Source, manifest.Commit, manifest.RailsEnv, manifest.CreatedAt.Format(time.RFC3339))
+	}
+	if publicKey == "" {
+		logger.Warn("Only checked the checksum, add --public-key to check the manifest is signed")
+	}
+	return nil
+}
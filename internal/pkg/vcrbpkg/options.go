@@ -0,0 +1,653 @@
+package vcrbpkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileName is the project configuration file read from the root of the
+// application.
+const ConfigFileName = ".vcrbpkg.yml"
+
+// envPrefix is the prefix of the environment variables that set options.
+const envPrefix = "VCRBPKG_"
+
+// Options control a packaging run. They are layered from the defaults, the
+// project configuration file, VCRBPKG_* environment variables and command line
+// flags, where the later ones take precedence.
+type Options struct {
+	// RubyVersion to use instead of the one determined from the application.
+	RubyVersion string `yaml:"ruby_version"`
+	// RailsEnv to use instead of testing for the best environment.
+	RailsEnv string `yaml:"rails_env"`
+	// Envs are the Rails environments to try, in order.
+	Envs []string `yaml:"envs"`
+	// Env are extra environment variables for bundle install, rails server and
+	// veracode prepare. Values can be secret://<provider>/<reference> to be
+	// resolved by a SecretProvider, but not in the .vcrbpkg.yml of the
+	// application, see checkSecretRefs.
+	Env map[string]string `yaml:"env"`
+	// SecretCommand is run with the reference as last argument to resolve
+	// secret://command/<reference>, for example "pass show". Like VaultAddr it
+	// is not read from the .vcrbpkg.yml of the application, see
+	// hostOnlyOptions.
+	SecretCommand string `yaml:"secret_command"`
+	// VaultAddr is the local Vault compatible HTTP API for secret://vault/
+	// references, VAULT_ADDR or a local Vault agent by default.
+	VaultAddr string `yaml:"vault_addr"`
+	// Hermetic only passes the variables in hermeticEnvAllowList and PassEnv
+	// from our environment to those commands, instead of all of them.
+	Hermetic bool `yaml:"hermetic"`
+	// PassEnv are the names of extra variables to pass in hermetic mode, names
+	// can end with * to match a prefix.
+	PassEnv []string `yaml:"pass_env"`
+	// BundleWithout are the gem groups to exclude per Rails environment,
+	// overriding the defaults.
+	BundleWithout map[string][]string `yaml:"bundle_without"`
+	// BootTimeout is how long rails server needs to keep running to consider
+	// the Rails environment working.
+	BootTimeout time.Duration `yaml:"boot_timeout"`
+	// Shims are Ruby files, relative to the application, required before
+	// booting the application, for example to stub out external services.
+	Shims []string `yaml:"shims"`
+	// MinCoverage is the minimum percentage of Ruby files that needs to be in
+	// the package, if set.
+	MinCoverage float64 `yaml:"min_coverage"`
+	// Validate is the policy for issues found in the package: off, warn, fail
+	// on errors or strict to also fail on warnings.
+	Validate string `yaml:"validate"`
+	// MaxPackageSize is the largest package that passes validation.
+	MaxPackageSize ByteSize `yaml:"max_package_size"`
+	// OnSecret is what to do with secrets found in the package: off, warn,
+	// fail or strip the entries with secrets.
+	OnSecret string `yaml:"on_secret"`
+	// SecretPatterns are regular expressions for secrets besides the
+	// built-in rules.
+	SecretPatterns []string `yaml:"secret_patterns"`
+	// AdvisoryDB is a ruby-advisory-db checkout to check the gems in
+	// Gemfile.lock against, if set.
+	AdvisoryDB string `yaml:"advisory_db"`
+	// FailOnSeverity fails the run for advisories of this severity or
+	// higher: low, medium, high or critical, if set.
+	FailOnSeverity string `yaml:"fail_on_severity"`
+	// OutFile to copy the packaged application to, if set. It can be a
+	// directory, a template like {{.Repo}}-{{.Commit}}.zip (see OutName) or
+	// - to stream the package to stdout.
+	OutFile string `yaml:"out"`
+	// Force overwrites an existing OutFile.
+	Force bool `yaml:"force"`
+	// SBOM writes a CycloneDX SBOM of the gems next to OutFile.
+	SBOM bool `yaml:"sbom"`
+	// SignKey is an ed25519 private key in PEM or a minisign secret key to
+	// sign the manifest of OutFile with, if set.
+	SignKey string `yaml:"sign_key"`
+	// SignPassword decrypts an encrypted minisign SignKey, it can be a
+	// secret://<provider>/<reference> to be resolved by a SecretProvider.
+	SignPassword string `yaml:"sign_password"`
+	// ReportFile to write the JSON report of the run to, if set.
+	ReportFile string `yaml:"report"`
+	// KnownFailuresFile with additional known failures to diagnose, if set.
+	KnownFailuresFile string `yaml:"known_failures"`
+	// InstallSystemDeps installs missing native libraries needed by gems.
+	InstallSystemDeps bool `yaml:"install_system_deps"`
+	// SystemDepsDryRun only lists the native libraries that would be installed.
+	SystemDepsDryRun bool `yaml:"system_deps_dry_run"`
+	// IsolateNetwork boots the application in a network namespace with only
+	// loopback (Linux only).
+	IsolateNetwork bool `yaml:"isolate_network"`
+	// StepTimeout is the maximum time for bundle install and veracode prepare
+	// in a Rails environment, if set.
+	StepTimeout time.Duration `yaml:"step_timeout"`
+	// MaxMemory, MaxCPUTime and MaxProcesses limit the resources of bundle
+	// install, rails server and veracode prepare if set, see Limits.
+	MaxMemory    ByteSize      `yaml:"max_memory"`
+	MaxCPUTime   time.Duration `yaml:"max_cpu_time"`
+	MaxProcesses int           `yaml:"max_processes"`
+}
+
+func defaultOptions() Options {
+	return Options{
+		Envs:           []string{"production", "development", "test"},
+		BootTimeout:    15 * time.Second,
+		Validate:       ValidateFail,
+		MaxPackageSize: DefaultMaxPackageSize,
+		OnSecret:       OnSecretWarn,
+		SBOM:           true,
+	}
+}
+
+// Overrides are option values from the command line by option (flag) name,
+// list options can have multiple values.
+type Overrides map[string][]string
+
+// option describes how to set an option from a flag or environment variable.
+type option struct {
+	name string
+	// list options take a comma separated list from environment variables.
+	list bool
+	set  func(opts *Options, values []string) error
+}
+
+var optionDefinitions = []option{
+	{name: "ruby-version", set: func(opts *Options, values []string) error {
+		opts.RubyVersion = last(values)
+		return nil
+	}},
+	{name: "rails-env", set: func(opts *Options, values []string) error {
+		opts.RailsEnv = last(values)
+		return nil
+	}},
+	{name: "envs", list: true, set: func(opts *Options, values []string) error {
+		opts.Envs = values
+		return nil
+	}},
+	{name: "env", list: true, set: func(opts *Options, values []string) error {
+		for _, value := range values {
+			key, val, found := strings.Cut(value, "=")
+			if !found {
+				return fmt.Errorf("invalid env '%s', expected KEY=VALUE", value)
+			}
+			if opts.Env == nil {
+				opts.Env = map[string]string{}
+			}
+			opts.Env[key] = val
+		}
+		return nil
+	}},
+	{name: "secret-command", set: func(opts *Options, values []string) error {
+		opts.SecretCommand = last(values)
+		return nil
+	}},
+	{name: "vault-addr", set: func(opts *Options, values []string) error {
+		opts.VaultAddr = last(values)
+		return nil
+	}},
+	{name: "hermetic", set: func(opts *Options, values []string) (err error) {
+		opts.Hermetic, err = parseBool(last(values))
+		return err
+	}},
+	{name: "pass-env", list: true, set: func(opts *Options, values []string) error {
+		opts.PassEnv = values
+		return nil
+	}},
+	{name: "bundle-without", list: true, set: func(opts *Options, values []string) error {
+		bundleWithout, err := ParseBundleWithout(values)
+		if err != nil {
+			return err
+		}
+		if opts.BundleWithout == nil {
+			opts.BundleWithout = map[string][]string{}
+		}
+		for railsEnv, groups := range bundleWithout {
+			opts.BundleWithout[railsEnv] = groups
+		}
+		return nil
+	}},
+	{name: "boot-timeout", set: func(opts *Options, values []string) (err error) {
+		opts.BootTimeout, err = parseDuration(last(values))
+		return err
+	}},
+	{name: "shims", list: true, set: func(opts *Options, values []string) error {
+		opts.Shims = values
+		return nil
+	}},
+	{name: "min-coverage", set: func(opts *Options, values []string) error {
+		minCoverage, err := strconv.ParseFloat(last(values), 64)
+		if err != nil {
+			return fmt.Errorf("invalid percentage '%s'", last(values))
+		}
+		opts.MinCoverage = minCoverage
+		return nil
+	}},
+	{name: "validate", set: func(opts *Options, values []string) error {
+		opts.Validate = last(values)
+		return nil
+	}},
+	{name: "max-package-size", set: func(opts *Options, values []string) (err error) {
+		opts.MaxPackageSize, err = ParseByteSize(last(values))
+		return err
+	}},
+	{name: "on-secret", set: func(opts *Options, values []string) error {
+		opts.OnSecret = last(values)
+		return nil
+	}},
+	{name: "secret-patterns", list: true, set: func(opts *Options, values []string) error {
+		opts.SecretPatterns = values
+		return nil
+	}},
+	{name: "advisory-db", set: func(opts *Options, values []string) error {
+		opts.AdvisoryDB = last(values)
+		return nil
+	}},
+	{name: "fail-on-severity", set: func(opts *Options, values []string) error {
+		opts.FailOnSeverity = last(values)
+		return nil
+	}},
+	{name: "out", set: func(opts *Options, values []string) error {
+		opts.OutFile = last(values)
+		return nil
+	}},
+	{name: "force", set: func(opts *Options, values []string) (err error) {
+		opts.Force, err = parseBool(last(values))
+		return err
+	}},
+	{name: "sbom", set: func(opts *Options, values []string) (err error) {
+		opts.SBOM, err = parseBool(last(values))
+		return err
+	}},
+	{name: "sign-key", set: func(opts *Options, values []string) error {
+		opts.SignKey = last(values)
+		return nil
+	}},
+	{name: "sign-password", set: func(opts *Options, values []string) error {
+		opts.SignPassword = last(values)
+		return nil
+	}},
+	{name: "report", set: func(opts *Options, values []string) error {
+		opts.ReportFile = last(values)
+		return nil
+	}},
+	{name: "known-failures", set: func(opts *Options, values []string) error {
+		opts.KnownFailuresFile = last(values)
+		return nil
+	}},
+	{name: "install-system-deps", set: func(opts *Options, values []string) (err error) {
+		opts.InstallSystemDeps, err = parseBool(last(values))
+		return err
+	}},
+	{name: "system-deps-dry-run", set: func(opts *Options, values []string) (err error) {
+		opts.SystemDepsDryRun, err = parseBool(last(values))
+		return err
+	}},
+	{name: "isolate-network", set: func(opts *Options, values []string) (err error) {
+		opts.IsolateNetwork, err = parseBool(last(values))
+		return err
+	}},
+	{name: "step-timeout", set: func(opts *Options, values []string) (err error) {
+		opts.StepTimeout, err = parseDuration(last(values))
+		return err
+	}},
+	{name: "max-memory", set: func(opts *Options, values []string) (err error) {
+		opts.MaxMemory, err = ParseByteSize(last(values))
+		return err
+	}},
+	{name: "max-cpu-time", set: func(opts *Options, values []string) (err error) {
+		opts.MaxCPUTime, err = parseDuration(last(values))
+		return err
+	}},
+	{name: "max-processes", set: func(opts *Options, values []string) error {
+		maxProcesses, err := strconv.Atoi(last(values))
+		if err != nil {
+			return fmt.Errorf("invalid number '%s'", last(values))
+		}
+		opts.MaxProcesses = maxProcesses
+		return nil
+	}},
+}
+
+func last(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration '%s', expected a duration like 30s", value)
+	}
+	return d, nil
+}
+
+func parseBool(value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean '%s', expected true or false", value)
+	}
+	return b, nil
+}
+
+// envName returns the environment variable for an option, for example
+// VCRBPKG_RUBY_VERSION for ruby-version.
+func (o option) envName() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+// LoadOptions layers the defaults, the configuration file, VCRBPKG_*
+// environment variables and overrides from the command line. Without an
+// explicit configFile (or VCRBPKG_CONFIG) the .vcrbpkg.yml in appRoot is used
+// if it exists.
+func LoadOptions(appRoot string, configFile string, overrides Overrides) (Options, error) {
+	opts := defaultOptions()
+
+	explicit := true
+	if configFile == "" {
+		configFile = os.Getenv(envPrefix + "CONFIG")
+	}
+	if configFile == "" {
+		configFile = filepath.Join(appRoot, ConfigFileName)
+		explicit = false
+	}
+	if err := readConfigFile(configFile, explicit, &opts); err != nil {
+		return Options{}, err
+	}
+
+	if err := applyEnvironment(&opts); err != nil {
+		return Options{}, err
+	}
+
+	if err := applyOverrides(&opts, overrides); err != nil {
+		return Options{}, err
+	}
+
+	if err := opts.validate(appRoot); err != nil {
+		return Options{}, err
+	}
+	return opts, nil
+}
+
+var unknownFieldRegex = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+func readConfigFile(configFile string, explicit bool, opts *Options) error {
+	content, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) && !explicit {
+		logger.Infof("No %s found, using defaults", configFile)
+		return nil
+	}
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to read configuration file %s", configFile)
+		return fmt.Errorf("unable to read configuration file %s", configFile)
+	}
+
+	logger.Infof("Reading configuration from %s", configFile)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(opts)
+	if errors.Is(err, io.EOF) {
+		// Empty configuration file
+		return nil
+	}
+	if err == nil && !explicit {
+		if err := checkHostOnlyOptions(configFile, content); err != nil {
+			return err
+		}
+		if err := checkSecretRefs(configFile, opts); err != nil {
+			return err
+		}
+	}
+
+	var typeError *yaml.TypeError
+	if errors.As(err, &typeError) {
+		message := fmt.Sprintf("invalid configuration file %s:", configFile)
+		unknownOption := false
+		for _, problem := range typeError.Errors {
+			if unknownFieldRegex.MatchString(problem) {
+				problem = unknownFieldRegex.ReplaceAllString(problem, "unknown option '$1'")
+				unknownOption = true
+			}
+			message += "\n  " + problem
+		}
+		if unknownOption {
+			message += "\nvalid options are: " + strings.Join(configKeys(), ", ")
+		}
+		return errors.New(message)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid configuration file %s: %v", configFile, err)
+	}
+	return nil
+}
+
+// hostOnlyOptions write files, run commands or send credentials on the host,
+// or switch off the checks of the package, so they can not be set by the
+// .vcrbpkg.yml of the application, which may come from an untrusted
+// repository. They can be set with flags, VCRBPKG_* environment variables or
+// an explicit --config.
+var hostOnlyOptions = []string{
+	// Files written on the host
+	"out", "force", "report", "sign_key", "sign_password",
+	// Commands, credentials and variables of the host
+	"secret_command", "vault_addr", "install_system_deps", "pass_env",
+	// Checks of the package
+	"validate", "max_package_size", "on_secret", "known_failures", "advisory_db", "fail_on_severity",
+}
+
+// checkHostOnlyOptions refuses hostOnlyOptions in the configuration file
+// content, whatever their value.
+func checkHostOnlyOptions(configFile string, content []byte) error {
+	var set map[string]yaml.Node
+	if err := yaml.Unmarshal(content, &set); err != nil {
+		return fmt.Errorf("invalid configuration file %s: %v", configFile, err)
+	}
+	var keys []string
+	for _, key := range hostOnlyOptions {
+		if _, found := set[key]; found {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("invalid configuration file %s: %s can not be set in the configuration of the application, use flags, %s* environment variables or --config instead", configFile, strings.Join(keys, ", "), envPrefix)
+	}
+	return nil
+}
+
+// checkSecretRefs refuses secret:// references in the .vcrbpkg.yml of the
+// application, they would hand host files, variables and Vault secrets to
+// the application it comes with.
+func checkSecretRefs(configFile string, opts *Options) error {
+	var keys []string
+	for key, value := range opts.Env {
+		if isSecretRef(value) {
+			keys = append(keys, "env "+key)
+		}
+	}
+	sort.Strings(keys)
+	if isSecretRef(opts.SignPassword) {
+		keys = append(keys, "sign_password")
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("invalid configuration file %s: %s can not be a %s reference in the configuration of the application, use flags, %s* environment variables or --config instead", configFile, strings.Join(keys, ", "), secretScheme, envPrefix)
+	}
+	return nil
+}
+
+// configKeys returns the keys allowed in the configuration file.
+func configKeys() []string {
+	var keys []string
+	for _, definition := range optionDefinitions {
+		keys = append(keys, strings.ReplaceAll(definition.name, "-", "_"))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func applyEnvironment(opts *Options) error {
+	for _, definition := range optionDefinitions {
+		value, found := os.LookupEnv(definition.envName())
+		if !found {
+			continue
+		}
+
+		values := []string{value}
+		if definition.list {
+			values = strings.FieldsFunc(value, func(r rune) bool { return r == ',' })
+		}
+		logger.Infof("Using %s from environment", definition.envName())
+		if err := definition.set(opts, values); err != nil {
+			return fmt.Errorf("invalid %s: %v", definition.envName(), err)
+		}
+	}
+	return nil
+}
+
+func applyOverrides(opts *Options, overrides Overrides) error {
+	for _, definition := range optionDefinitions {
+		values, found := overrides[definition.name]
+		if !found {
+			continue
+		}
+		if err := definition.set(opts, values); err != nil {
+			return fmt.Errorf("invalid --%s: %v", definition.name, err)
+		}
+	}
+	return nil
+}
+
+var (
+	versionRegex  = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+	railsEnvRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	envVarRegex   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// limits returns the configured resource limits.
+func (opts Options) limits() Limits {
+	return Limits{Memory: opts.MaxMemory, CPUTime: opts.MaxCPUTime, Processes: opts.MaxProcesses}
+}
+
+// validate checks the options make sense, reporting all problems at once.
+func (opts Options) validate(appRoot string) error {
+	var problems []string
+
+	if opts.RubyVersion != "" && !versionRegex.MatchString(opts.RubyVersion) {
+		problems = append(problems, fmt.Sprintf("ruby_version: '%s' is not a x.y.z version", opts.RubyVersion))
+	}
+
+	if opts.RailsEnv != "" && !railsEnvRegex.MatchString(opts.RailsEnv) {
+		problems = append(problems, fmt.Sprintf("rails_env: '%s' is not a valid Rails environment name", opts.RailsEnv))
+	}
+
+	if len(opts.Envs) == 0 {
+		problems = append(problems, "envs: at least one Rails environment is needed")
+	}
+	for _, railsEnv := range opts.Envs {
+		if !railsEnvRegex.MatchString(railsEnv) {
+			problems = append(problems, fmt.Sprintf("envs: '%s' is not a valid Rails environment name", railsEnv))
+		}
+	}
+
+	for key, value := range opts.Env {
+		if !envVarRegex.MatchString(key) {
+			problems = append(problems, fmt.Sprintf("env: '%s' is not a valid environment variable name", key))
+		}
+		if isSecretRef(value) {
+			if provider, _, err := parseSecretRef(value); err != nil {
+				problems = append(problems, fmt.Sprintf("env: %s: %v", key, err))
+			} else if provider == "command" && opts.SecretCommand == "" {
+				problems = append(problems, fmt.Sprintf("env: %s: secret_command is needed for %s", key, value))
+			}
+		}
+	}
+
+	for _, name := range opts.PassEnv {
+		if !envVarRegex.MatchString(strings.TrimSuffix(name, "*")) {
+			problems = append(problems, fmt.Sprintf("pass_env: '%s' is not a valid environment variable name", name))
+		}
+	}
+
+	for railsEnv := range opts.BundleWithout {
+		if !railsEnvRegex.MatchString(railsEnv) {
+			problems = append(problems, fmt.Sprintf("bundle_without: '%s' is not a valid Rails environment name", railsEnv))
+		}
+	}
+
+	if opts.BootTimeout < time.Second {
+		problems = append(problems, fmt.Sprintf("boot_timeout: %s is too short, use a duration like 30s", opts.BootTimeout))
+	}
+
+	if opts.StepTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("step_timeout: %s can not be negative", opts.StepTimeout))
+	}
+	if opts.MaxCPUTime < 0 {
+		problems = append(problems, fmt.Sprintf("max_cpu_time: %s can not be negative", opts.MaxCPUTime))
+	} else if opts.MaxCPUTime > 0 && opts.MaxCPUTime < time.Second {
+		problems = append(problems, fmt.Sprintf("max_cpu_time: %s is too short, CPU time is limited in seconds", opts.MaxCPUTime))
+	}
+	if opts.MaxMemory > 0 && opts.MaxMemory < 64<<20 {
+		problems = append(problems, fmt.Sprintf("max_memory: %s is too little to run Ruby, use a size like 2G", opts.MaxMemory))
+	}
+	if opts.MaxProcesses < 0 {
+		problems = append(problems, fmt.Sprintf("max_processes: %d can not be negative", opts.MaxProcesses))
+	}
+
+	if opts.MinCoverage < 0 || opts.MinCoverage > 100 {
+		problems = append(problems, fmt.Sprintf("min_coverage: %g is not a percentage between 0 and 100", opts.MinCoverage))
+	}
+
+	if !isOneOf(opts.Validate, validatePolicies) {
+		problems = append(problems, fmt.Sprintf("validate: '%s' is not one of %s", opts.Validate, strings.Join(validatePolicies, ", ")))
+	}
+	if !isOneOf(opts.OnSecret, onSecretPolicies) {
+		problems = append(problems, fmt.Sprintf("on_secret: '%s' is not one of %s", opts.OnSecret, strings.Join(onSecretPolicies, ", ")))
+	}
+	if _, err := compileSecretPatterns(opts.SecretPatterns); err != nil {
+		problems = append(problems, fmt.Sprintf("secret_patterns: %v", err))
+	}
+
+	if opts.AdvisoryDB != "" {
+		if err := checkAdvisoryDB(opts.AdvisoryDB); err != nil {
+			problems = append(problems, fmt.Sprintf("advisory_db: %v", err))
+		}
+	}
+	if opts.FailOnSeverity != "" {
+		if !isOneOf(opts.FailOnSeverity, severities) {
+			problems = append(problems, fmt.Sprintf("fail_on_severity: '%s' is not one of %s", opts.FailOnSeverity, strings.Join(severities, ", ")))
+		} else if opts.AdvisoryDB == "" {
+			problems = append(problems, "fail_on_severity: advisory_db is needed to check the gems for advisories")
+		}
+	}
+
+	if isOutTemplate(opts.OutFile) {
+		if _, err := parseOutTemplate(opts.OutFile); err != nil {
+			problems = append(problems, fmt.Sprintf("out: %v", err))
+		}
+	} else if opts.OutFile != "" && opts.OutFile != stdoutFile && !isOutDirectory(opts.OutFile) {
+		// Fail before packaging, the files are checked again when exporting
+		for _, file := range exportFiles(opts.OutFile, opts, nil) {
+			if err := checkOverwrite(file, opts.Force); err != nil {
+				problems = append(problems, fmt.Sprintf("out: %v", err))
+			}
+		}
+	}
+	if opts.SignKey != "" && opts.OutFile == "" {
+		problems = append(problems, "sign_key: out is needed to sign the exported package")
+	} else if opts.SignKey != "" && opts.OutFile == stdoutFile {
+		problems = append(problems, "sign_key: the manifest can not be signed when streaming the package to stdout")
+	}
+	if opts.VaultAddr != "" {
+		if err := checkLoopbackAddr(opts.VaultAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("vault_addr: %v", err))
+		}
+	}
+	if isSecretRef(opts.SignPassword) {
+		if provider, _, err := parseSecretRef(opts.SignPassword); err != nil {
+			problems = append(problems, fmt.Sprintf("sign_password: %v", err))
+		} else if provider == "command" && opts.SecretCommand == "" {
+			problems = append(problems, fmt.Sprintf("sign_password: secret_command is needed for %s", opts.SignPassword))
+		}
+	}
+
+	for _, shim := range opts.Shims {
+		if _, err := os.Stat(filepath.Join(appRoot, shim)); err != nil {
+			problems = append(problems, fmt.Sprintf("shims: '%s' not found in %s", shim, appRoot))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package vcrbpkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// stdoutFile as out streams the package to stdout.
+const stdoutFile = "-"
+
+// defaultOutName is the name of the package when out is a directory.
+const defaultOutName = "{{.Repo}}.zip"
+
+// OutName are the fields for out templates, like
+// {{.Repo}}-{{.Commit}}-{{.RailsEnv}}.zip.
+type OutName struct {
+	// Repo is the name of the repository or directory of the application.
+	Repo string
+	// Commit is the short commit SHA and CommitSHA the full one, empty
+	// outside a git checkout.
+	Commit       string
+	CommitSHA    string
+	RailsEnv     string
+	RubyVersion  string
+	RailsVersion string
+	// Date is the date of the run as 20060102.
+	Date string
+}
+
+// shortCommitLength is the length of the commit SHA in {{.Commit}}.
+const shortCommitLength = 12
+
+// unsafeFileNameChars are replaced in the template fields, so they can not
+// add directories.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._+-]+`)
+
+// isOutTemplate returns whether out has template fields.
+func isOutTemplate(out string) bool {
+	return strings.Contains(out, "{{")
+}
+
+// isOutDirectory returns whether out is a directory to write the package to,
+// an existing one or one ending with a separator.
+func isOutDirectory(out string) bool {
+	if strings.HasSuffix(out, "/") || strings.HasSuffix(out, string(filepath.Separator)) {
+		return true
+	}
+	stat, err := os.Stat(out)
+	return err == nil && stat.IsDir()
+}
+
+// parseOutTemplate parses out as template, failing on unknown fields.
+func parseOutTemplate(out string) (*template.Template, error) {
+	tmpl, err := template.New("out").Option("missingkey=error").Parse(out)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template '%s': %v", out, err)
+	}
+	if err := tmpl.Execute(&bytes.Buffer{}, OutName{}); err != nil {
+		return nil, fmt.Errorf("invalid template '%s': %v", out, err)
+	}
+	return tmpl, nil
+}
+
+// newOutName returns the template fields for a package described by
+// manifest.
+func newOutName(input string, repoFolder string, manifest *Manifest) OutName {
+	name := OutName{
+		Repo:         repoName(input, repoFolder),
+		CommitSHA:    manifest.Commit,
+		Commit:       manifest.Commit,
+		RailsEnv:     manifest.RailsEnv,
+		RubyVersion:  manifest.RubyVersion,
+		RailsVersion: manifest.RailsVersion,
+		Date:         manifest.CreatedAt.Format("20060102"),
+	}
+	if len(name.Commit) > shortCommitLength {
+		name.Commit = name.Commit[:shortCommitLength]
+	}
+	for _, field := range []*string{&name.Repo, &name.Commit, &name.CommitSHA, &name.RailsEnv, &name.RubyVersion, &name.RailsVersion, &name.Date} {
+		*field = strings.Trim(unsafeFileNameChars.ReplaceAllString(*field, "-"), "-.")
+	}
+	if name.Repo == "" {
+		name.Repo = "package"
+	}
+	return name
+}
+
+// repoName returns the name of the repository URL or the directory of the
+// application.
+func repoName(input string, repoFolder string) string {
+	if repoFolder != input {
+		// Cloned from a URL like https://github.com/user/repo.git or git@host:user/repo
+		trimmed := strings.TrimSuffix(strings.TrimRight(input, "/"), ".git")
+		return path.Base(strings.ReplaceAll(trimmed, ":", "/"))
+	}
+	if abs, err := filepath.Abs(repoFolder); err == nil {
+		return filepath.Base(abs)
+	}
+	return filepath.Base(repoFolder)
+}
+
+// resolveOutFile returns the file to export the package to for out, which is
+// a file, a directory to write defaultOutName to or a template.
+func resolveOutFile(out string, name OutName) (string, error) {
+	if isOutDirectory(out) {
+		out = filepath.Join(out, defaultOutName)
+	}
+	if isOutTemplate(out) {
+		tmpl, err := parseOutTemplate(out)
+		if err != nil {
+			return "", err
+		}
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, name); err != nil {
+			return "", fmt.Errorf("invalid template '%s': %v", out, err)
+		}
+		out = rendered.String()
+	}
+	return filepath.Abs(out)
+}
+
+// OutExistsError is returned when the file to export to exists and may not
+// be overwritten.
+type OutExistsError struct {
+	File string
+}
+
+func (e *OutExistsError) Error() string {
+	return fmt.Sprintf("%s already exists, use --force (or force: true) to overwrite it", e.File)
+}
+
+// exportFiles returns the files written when exporting the package to
+// outFile: the package, its checksum, manifest, signature and SBOM.
+func exportFiles(outFile string, opts Options, signer *signingKey) []string {
+	files := []string{outFile, checksumFile(outFile), manifestFile(outFile)}
+	if signer != nil {
+		files = append(files, manifestFile(outFile)+signatureExtensions[signer.format])
+	}
+	if opts.SBOM {
+		files = append(files, sbomFile(outFile))
+	}
+	return files
+}
+
+// checkOverwrite fails when file exists, unless force is set.
+func checkOverwrite(file string, force bool) error {
+	if force {
+		return nil
+	}
+	_, err := os.Stat(file)
+	if err == nil {
+		return &OutExistsError{File: file}
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to check if %s exists: %v", file, err)
+	}
+	return nil
+}
@@ -2,72 +2,168 @@ package vcrbpkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
 )
 
-func Package(args []string, outFile string) error {
+// Package packages the Rails application in the folder or repository URL in
+// args (the current directory by default). Options are loaded from configFile
+// or the .vcrbpkg.yml of the application with overrides from the command line.
+func Package(ctx context.Context, args []string, configFile string, overrides Overrides) (err error) {
 	var repoFolder string
 	var rubyVersion Version
 
-	// Prereqs
-	err := ensureRubyIsInstalledGlobally()
-	if err != nil {
-		return err
-	}
-	err = ensureRvmIsInstalledGlobally()
-	if err != nil {
-		return err
-	}
-
 	var input string
 	if len(args) == 0 {
 		input = "."
 	} else {
 		input = args[0]
 	}
+
+	// Until the options are loaded we do not know if the package is streamed
+	// to stdout, so keep stdout clean while cloning and reading them
+	outputToStderr()
+
 	if isAlreadyDirectory(input) {
 		repoFolder = input
 	} else {
-		repoFolder, err = cloneRepo(input)
+		repoFolder, err = cloneRepo(ctx, input)
 		if err != nil {
 			return err
 		}
 	}
 
+	opts, err := LoadOptions(repoFolder, configFile, overrides)
+	if err != nil {
+		return err
+	}
+	if opts.OutFile != stdoutFile {
+		outputToStdout()
+	}
+	if err = resolveSecrets(ctx, &opts); err != nil {
+		return err
+	}
+	// Load the signing key first, a wrong password should not wait for packaging
+	var signer *signingKey
+	if opts.SignKey != "" {
+		if signer, err = loadSigningKey(opts.SignKey, opts.SignPassword); err != nil {
+			return err
+		}
+	}
+
+	knownFailures, err := loadKnownFailures(opts.KnownFailuresFile)
+	if err != nil {
+		return err
+	}
+	report := newReport(input, knownFailures)
+	report.RepoFolder = repoFolder
+	if opts.ReportFile != "" {
+		defer func() {
+			report.finish(err)
+			if writeErr := report.write(opts.ReportFile); writeErr != nil && err == nil {
+				err = writeErr
+			}
+		}()
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("interrupted, stopped all running commands: %v", err)
+		}
+	}()
+
+	// Prereqs
+	err = ensureRubyIsInstalledGlobally(ctx)
+	if err != nil {
+		return err
+	}
+	err = ensureRvmIsInstalledGlobally(ctx)
+	if err != nil {
+		return err
+	}
+	if err = checkSandbox(ctx, opts); err != nil {
+		return err
+	}
+
 	if err = ensureHasRailsStructure(repoFolder); err != nil {
 		return err
 	}
+	// Before packaging, vulnerable gems fail the run in seconds
+	if err = auditGems(ctx, repoFolder, opts, report); err != nil {
+		return err
+	}
+
+	// Scratch space for the run, like caches we do not want in the application
+	workspace, err := os.MkdirTemp("", "vcrbpkg-workspace-")
+	if err != nil {
+		logger.WithError(err).Error("Unable to create workspace")
+		return fmt.Errorf("unable to create workspace")
+	}
+	defer os.RemoveAll(workspace)
+	disableBootAccelerators(repoFolder, workspace, &opts, report)
+
+	if opts.InstallSystemDeps || opts.SystemDepsDryRun {
+		if err = installSystemDeps(ctx, repoFolder, opts.SystemDepsDryRun); err != nil {
+			return err
+		}
+	}
 
-	rubyVersion = determineRubyVersion(repoFolder)
+	if opts.RubyVersion != "" {
+		logger.Infof("Using configured Ruby version: %s", opts.RubyVersion)
+		rubyVersion = parseRubyVersion(opts.RubyVersion)
+	} else {
+		rubyVersion = determineRubyVersion(repoFolder)
+	}
+	report.RubyVersion = rubyVersion.String()
 	checkIsSupportedRubyVersion(rubyVersion)
-	if err = rvmInstallRuby(repoFolder, rubyVersion); err != nil {
+	bundlerVersion := determineBundlerVersion(repoFolder)
+	report.BundlerVersion = bundlerVersion
+	if err = rvmInstallRuby(ctx, repoFolder, rubyVersion, bundlerVersion, report); err != nil {
 		return err
 	}
-	checkIsSupportedRailsVersion(repoFolder, rubyVersion)
-	if err = installVeracodeGem(repoFolder, rubyVersion); err != nil {
+	checkIsSupportedRailsVersion(ctx, repoFolder, rubyVersion, bundlerVersion)
+	if err = installVeracodeGem(ctx, repoFolder, rubyVersion, bundlerVersion); err != nil {
 		return err
 	}
-	railsEnv := testForBestEnv(repoFolder, rubyVersion)
-
-	packagedFile, err := runVeracodePrepare(repoFolder, rubyVersion, railsEnv)
+	packagedFile, railsEnv, err := prepareInBestEnv(ctx, repoFolder, rubyVersion, bundlerVersion, opts, report)
 	if err != nil {
 		return err
 	}
-	if outFile != "" {
-		copyFile(packagedFile, outFile)
+	report.RailsEnv = railsEnv
+	report.PackagedFile = packagedFile
+	if err = validatePackage(packagedFile, opts, report); err != nil {
+		return err
+	}
+	if err = scanSecrets(packagedFile, opts, report); err != nil {
+		return err
+	}
+	if err = checkCoverage(repoFolder, packagedFile, opts.MinCoverage, report); err != nil {
+		return err
+	}
+	if opts.OutFile != "" {
+		// Before exporting, so the manifest covers it and a failure does not
+		// leave a package without SBOM
+		var sbom []byte
+		if sbom, err = generateSBOM(ctx, input, repoFolder, rubyVersion, opts); err != nil {
+			return err
+		}
+		if err = exportPackage(ctx, input, repoFolder, packagedFile, sbom, opts, signer, report); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func ensureRubyIsInstalledGlobally() error {
+func ensureRubyIsInstalledGlobally(ctx context.Context) error {
 	command := "ruby"
 
 	// LookPath returns the complete path to the binary or an error if not found
@@ -83,7 +179,7 @@ func ensureRubyIsInstalledGlobally() error {
 	cmd := exec.Command("ruby", "--version")
 
 	// Run the command and capture its output
-	output, err := cmd.CombinedOutput()
+	output, err := outputCommand(ctx, cmd)
 	if err != nil {
 		logger.WithError(err).Error("Unable to run ruby --version command")
 		return fmt.Errorf("unable to run ruby --version command, please ensure ruby is installed correctly")
@@ -94,7 +190,7 @@ func ensureRubyIsInstalledGlobally() error {
 	return nil
 }
 
-func ensureRvmIsInstalledGlobally() error {
+func ensureRvmIsInstalledGlobally(ctx context.Context) error {
 	command := "rvm"
 
 	// LookPath returns the complete path to the binary or an error if not found
@@ -110,7 +206,7 @@ func ensureRvmIsInstalledGlobally() error {
 	cmd := exec.Command("rvm", "version")
 
 	// Run the command and capture its output
-	output, err := cmd.CombinedOutput()
+	output, err := outputCommand(ctx, cmd)
 	if err != nil {
 		logger.WithError(err).Error("Unable to run rvm version command")
 		return fmt.Errorf("unable to run rvm version command. Please reinstall RVM")
@@ -143,7 +239,7 @@ func isAlreadyDirectory(dirPath string) bool {
 	}
 }
 
-func cloneRepo(urlOrFolder string) (string, error) {
+func cloneRepo(ctx context.Context, urlOrFolder string) (string, error) {
 	// Check if the given path is an existing directory
 	if fi, err := os.Stat(urlOrFolder); err == nil && fi.IsDir() {
 		logger.Infof("Folder '%s' already exists. Skipping clone.", urlOrFolder)
@@ -173,12 +269,13 @@ func cloneRepo(urlOrFolder string) (string, error) {
 
 	// Run 'git clone' command
 	cmd := exec.Command("git", "clone", "--depth", "1", urlOrFolder, temporaryDir)
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = commandOutput
 	cmd.Stderr = os.Stderr
 
 	logger.Infof("Cloning repository from %s...\n", urlOrFolder)
 
-	err = cmd.Run()
+	// In the foreground, git and ssh may ask for credentials
+	err = runForegroundCommand(ctx, cmd)
 	if err != nil {
 		logger.WithError(err).Errorf("failed to clone repository '%s' to '%s'", urlOrFolder, temporaryDir)
 		return "", fmt.Errorf("failed to clone repository '%s' to '%s'", urlOrFolder, temporaryDir)
@@ -203,15 +300,15 @@ func ensureHasRailsStructure(repoFolder string) error {
 	return nil
 }
 
-func checkIsSupportedRailsVersion(repoFolder string, rubyVersion Version) {
+func checkIsSupportedRailsVersion(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string) {
 	logger.Info("Detecting Rails version with Bundler")
 
-	cmd := exec.Command("rvm", rubyVersion.String()+"@veracode", "do", "bundle", "show", "rails")
+	cmd := bundleCommand(rubyVersion, bundlerVersion, "show", "rails")
 	cmd.Dir = repoFolder
 	var so saveOutput
 	cmd.Stdout = &so
 	cmd.Stderr = &so
-	err := cmd.Run()
+	err := runCommand(ctx, cmd)
 
 	if err != nil {
 		logger.WithError(err).Errorf("failed to bundle show rails")
@@ -242,11 +339,17 @@ func checkIsSupportedRailsVersion(repoFolder string, rubyVersion Version) {
 	}
 }
 
-func rvmInstallRuby(repoFolder string, rubyVersion Version) error {
+// needsRvmOpenSSL returns whether rubyVersion is built against the OpenSSL 1.1
+// of RVM, as only Ruby 3.1 and later build against OpenSSL 3.
+func needsRvmOpenSSL(rubyVersion Version) bool {
+	return rubyVersion.LowerThan(parseRubyVersion("3.1.0"))
+}
+
+func rvmInstallRuby(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string, report *Report) error {
 	var rvmInstallCmd *exec.Cmd
 
 	// https://wiki.archlinux.org/title/RVM#RVM_uses_wrong_OpenSSL_version
-	if rubyVersion.LowerThan(parseRubyVersion("3.0.0")) {
+	if needsRvmOpenSSL(rubyVersion) {
 		// Install OpenSSL in RVM because the system OpenSSL might be incompatible
 		opensslInstallCmd := exec.Command("rvm", "pkg", "install", "openssl")
 		opensslInstallCmd.Dir = repoFolder
@@ -256,7 +359,7 @@ func rvmInstallRuby(repoFolder string, rubyVersion Version) error {
 
 		logger.Info("Installing OpenSSL for RVM")
 
-		err := opensslInstallCmd.Run()
+		err := runCommand(ctx, opensslInstallCmd)
 		if err != nil {
 			logger.WithError(err).Warnf("failed to install openssl for rvm")
 		}
@@ -285,7 +388,7 @@ func rvmInstallRuby(repoFolder string, rubyVersion Version) error {
 
 	logger.Info("Installing Ruby version with RVM, this may take a while")
 
-	err := rvmInstallCmd.Run()
+	err := runCommand(ctx, rvmInstallCmd)
 
 	if err != nil {
 		logger.WithError(err).Error("failed to  rvm install")
@@ -303,8 +406,11 @@ func rvmInstallRuby(repoFolder string, rubyVersion Version) error {
 				logger.Fatalf("unable to read file %s: %v", filePath, err)
 			}
 			logger.Errorf("Make output: %s", logFileContents)
+			rvmInstallSavedOutput.savedOutput = append(rvmInstallSavedOutput.savedOutput, logFileContents...)
 		}
 
+		report.Diagnose(stepRvmInstall, rvmInstallSavedOutput.savedOutput)
+
 		return fmt.Errorf("failed to rvm install %s", rubyVersion.String())
 	}
 
@@ -313,94 +419,278 @@ func rvmInstallRuby(repoFolder string, rubyVersion Version) error {
 	// Run 'rvm install' command
 	cmd3 := exec.Command("rvm", rubyVersion.String(), "do", "rvm", "gemset", "create", "veracode")
 	cmd3.Dir = repoFolder
-	cmd3.Stdout = os.Stdout
+	cmd3.Stdout = commandOutput
 	cmd3.Stderr = os.Stderr
 
-	err = cmd3.Run()
+	err = runCommand(ctx, cmd3)
 	if err != nil {
 		logger.WithError(err).Errorf("failed to create gemset")
 		return fmt.Errorf("failed to create gemset for ruby version: %s", rubyVersion.String())
 	}
 
-	return nil
+	return installBundler(ctx, repoFolder, rubyVersion, bundlerVersion)
 }
 
 // Test which environment works best to by running `rails server`
 // production is best because it does not have all the develoment tooling
 // but then typically production does not work without some setup.
-func testForBestEnv(repoFolder string, rubyVersion Version) string {
-	testEnvs := []string{"production", "development", "test"}
-	for _, testEnv := range testEnvs {
-		var cmd4 *exec.Cmd
-		if testEnv == "production" {
-			cmd4 = exec.Command("rvm", rubyVersion.String()+"@veracode", "do", "bundle", "install", "--without", "development", "test")
-		} else {
-			cmd4 = exec.Command("rvm", rubyVersion.String()+"@veracode", "do", "bundle", "install")
+// Veracode Prepare runs in every environment that boots, in order, until it
+// succeeds in one of them.
+func prepareInBestEnv(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string, opts Options, report *Report) (string, string, error) {
+	if opts.RailsEnv != "" {
+		if !hasRailsEnvironment(repoFolder, opts.RailsEnv) {
+			return "", "", fmt.Errorf("rails environment %s not found in config/environments (available: %s)",
+				opts.RailsEnv, strings.Join(railsEnvironments(repoFolder), ", "))
+		}
+		logger.Infof("Using configured Rails environment %s, skipping testing for the best environment", opts.RailsEnv)
+		outcome := prepareInEnv(ctx, repoFolder, rubyVersion, bundlerVersion, opts.RailsEnv, opts, report, false)
+		if outcome.Prepare != outcomeOK {
+			return "", "", fmt.Errorf("failed to run veracode prepare in %s: %w", opts.RailsEnv, outcome.err)
 		}
-		cmd4.Dir = repoFolder
-		cmd4.Stdout = os.Stdout
-		cmd4.Stderr = os.Stderr
+		return outcome.packagedFile, opts.RailsEnv, nil
+	}
 
-		logger.Info("Doing Bundle Install")
+	fallbackEnv := ""
+	booted := false
+	for _, testEnv := range opts.Envs {
+		if ctx.Err() != nil {
+			return "", "", ctx.Err()
+		}
+		if !hasRailsEnvironment(repoFolder, testEnv) {
+			logger.Warnf("Skipping Rails environment %s, config/environments/%s.rb not found (available: %s)",
+				testEnv, testEnv, strings.Join(railsEnvironments(repoFolder), ", "))
+			report.Environments = append(report.Environments, EnvironmentOutcome{
+				RailsEnv: testEnv,
+				Error:    "not found in config/environments",
+			})
+			continue
+		}
+		if fallbackEnv == "" {
+			fallbackEnv = testEnv
+		}
 
-		err := cmd4.Run()
-		if err != nil {
-			logger.WithError(err).Warnf("failed to do bundle install, trying to run server anyway, will probably fail")
+		outcome := prepareInEnv(ctx, repoFolder, rubyVersion, bundlerVersion, testEnv, opts, report, true)
+		if outcome.Boot == outcomeOK {
+			booted = true
+		}
+		if outcome.Prepare == outcomeOK {
+			return outcome.packagedFile, testEnv, nil
 		}
+	}
+
+	if !booted && fallbackEnv != "" && ctx.Err() == nil {
+		logger.Warnf("Testing failed for all known environments, trying our luck with %s", fallbackEnv)
+		outcome := prepareInEnv(ctx, repoFolder, rubyVersion, bundlerVersion, fallbackEnv, opts, report, false)
+		if outcome.Prepare == outcomeOK {
+			return outcome.packagedFile, fallbackEnv, nil
+		}
+	}
+
+	logEnvironmentOutcomes(report.Environments)
+	if len(report.LimitsExceeded) > 0 {
+		return "", "", fmt.Errorf("failed to run veracode prepare, tried all environments: %s: %w",
+			strings.Join(opts.Envs, ", "), report.LimitsExceeded[len(report.LimitsExceeded)-1])
+	}
+	return "", "", fmt.Errorf("failed to run veracode prepare, tried all environments: %s", strings.Join(opts.Envs, ", "))
+}
+
+// prepareInEnv installs the gems for railsEnv and runs Veracode Prepare, if
+// testBoot is set only when rails server boots in railsEnv. The outcome is
+// added to the report.
+func prepareInEnv(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string, railsEnv string, opts Options, report *Report, testBoot bool) EnvironmentOutcome {
+	outcome := EnvironmentOutcome{RailsEnv: railsEnv}
+	defer func() {
+		report.Environments = append(report.Environments, outcome)
+	}()
+
+	if err := bundleInstall(ctx, repoFolder, rubyVersion, bundlerVersion, railsEnv, opts, report); err != nil {
+		outcome.BundleInstall = report.failedOutcome(err)
+	} else {
+		outcome.BundleInstall = outcomeOK
+	}
 
-		if testWithEnv(repoFolder, rubyVersion, testEnv) {
-			logger.Infof("Successfully verfied Rails environment %s, using it for Veracode Prepare", testEnv)
-			return testEnv
+	if testBoot {
+		if err := testWithEnv(ctx, repoFolder, rubyVersion, bundlerVersion, railsEnv, opts, report); err != nil {
+			outcome.Boot = report.failedOutcome(err)
+			outcome.Error = err.Error()
+			outcome.err = err
+			return outcome
 		}
+		outcome.Boot = outcomeOK
+		logger.Infof("Successfully verfied Rails environment %s, using it for Veracode Prepare", railsEnv)
+	} else {
+		outcome.Boot = outcomeSkipped
+	}
+
+	packagedFile, err := runVeracodePrepare(ctx, repoFolder, rubyVersion, bundlerVersion, railsEnv, opts, report)
+	if err != nil {
+		logger.Warnf("Veracode Prepare failed in Rails environment %s", railsEnv)
+		outcome.Prepare = report.failedOutcome(err)
+		outcome.Error = err.Error()
+		outcome.err = err
+		return outcome
+	}
+
+	outcome.Prepare = outcomeOK
+	outcome.packagedFile = packagedFile
+	return outcome
+}
+
+func logEnvironmentOutcomes(outcomes []EnvironmentOutcome) {
+	for _, outcome := range outcomes {
+		logger.Errorf("Rails environment %s: bundle install %s, boot %s, prepare %s %s",
+			outcome.RailsEnv,
+			orNotRun(outcome.BundleInstall),
+			orNotRun(outcome.Boot),
+			orNotRun(outcome.Prepare),
+			outcome.Error)
+	}
+}
+
+func orNotRun(outcome string) string {
+	if outcome == "" {
+		return "not run"
+	}
+	return outcome
+}
+
+func bundleInstall(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string, railsEnv string, opts Options, report *Report) error {
+	withoutGroups := bundleWithoutGroups(opts.BundleWithout, railsEnv)
+	cmd4 := bundleCommand(rubyVersion, bundlerVersion, "install")
+	cmd4.Env = bundleEnv(opts, railsEnv)
+	cmd4.Dir = repoFolder
+	var so saveOutput
+	cmd4.Stdout = &so
+	cmd4.Stderr = &so
+
+	if len(withoutGroups) == 0 {
+		logger.Infof("Doing Bundle Install for %s with all groups", railsEnv)
+	} else {
+		logger.Infof("Doing Bundle Install for %s without groups: %s", railsEnv, strings.Join(withoutGroups, ", "))
 	}
 
-	logger.Warn("Testing failed for all known environments, trying our luck with production")
-	return "production"
+	err := runLimited(ctx, cmd4, stepBundleInstall, opts, opts.StepTimeout)
+	if err != nil {
+		logger.WithError(err).Warnf("failed to do bundle install, trying to run server anyway, will probably fail")
+		report.Diagnose(stepBundleInstall, so.savedOutput)
+		return err
+	}
+	return nil
+}
+
+// hasRailsEnvironment returns whether the application defines railsEnv in
+// config/environments.
+func hasRailsEnvironment(repoFolder string, railsEnv string) bool {
+	_, err := os.Stat(filepath.Join(repoFolder, "config", "environments", railsEnv+".rb"))
+	return err == nil
+}
+
+// railsEnvironments returns the environments defined in config/environments.
+func railsEnvironments(repoFolder string) []string {
+	files, _ := filepath.Glob(filepath.Join(repoFolder, "config", "environments", "*.rb"))
+	var railsEnvs []string
+	for _, file := range files {
+		railsEnvs = append(railsEnvs, strings.TrimSuffix(filepath.Base(file), ".rb"))
+	}
+	return railsEnvs
 }
 
-func testWithEnv(repoFolder string, rubyVersion Version, railsEnv string) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+// testWithEnv returns nil when rails server keeps running in railsEnv for the
+// boot timeout.
+func testWithEnv(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string, railsEnv string, opts Options, report *Report) error {
+	bootCtx, cancel := context.WithTimeout(ctx, opts.BootTimeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "rvm", rubyVersion.String()+"@veracode", "do", "rails", "server")
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "RAILS_ENV="+railsEnv)
+	// A server.pid left behind by an earlier run makes rails server refuse to start
+	removeServerPidFile(repoFolder)
+	defer removeServerPidFile(repoFolder)
+
+	// Use a free port on loopback only, so concurrent runs and anything
+	// already listening on port 3000 do not get in the way
+	port, err := freePort()
+	if err != nil {
+		logger.WithError(err).Error("Unable to find a free port for rails server")
+		return fmt.Errorf("unable to find a free port for rails server")
+	}
+	logger.Debugf("Using port %d on %s for rails server in %s", port, bootBindAddress, railsEnv)
+
+	cmd := exec.Command(
+		"rvm", rubyVersion.String()+"@veracode", "do",
+		"rails", "server",
+		"--binding", bootBindAddress,
+		"--port", strconv.Itoa(port))
+	cmd.Env = appEnv(repoFolder, opts, railsEnv, bundlerVersion)
+	cmd.Env = append(cmd.Env, "PORT="+strconv.Itoa(port))
 	cmd.Dir = repoFolder
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	var so saveOutput
+	cmd.Stdout = &so
+	cmd.Stderr = &so
 
 	logger.Infof("Running rails server in %s", railsEnv)
 
-	if err := cmd.Run(); err != nil {
-		logger.WithError(err).Info("rails server error")
-		if err.Error() == "signal: killed" {
-			logger.Infof("Server ran until getting killed, nice!")
-			return true
-		} else {
-			logger.WithError(err).Warn("Unknown error, server failed")
-			return false
-		}
+	// The boot timeout is not a limit, running until it is what we want
+	err = runLimited(bootCtx, cmd, stepRailsServer, opts, 0)
+	if ctx.Err() != nil {
+		logger.Warn("Interrupted while running rails server")
+		return ctx.Err()
+	}
+	var limitErr *LimitExceededError
+	if errors.As(err, &limitErr) {
+		logger.WithError(err).Warn("Server stopped for exceeding a limit")
+		return err
+	}
+	if bootCtx.Err() == context.DeadlineExceeded {
+		logger.Infof("Server ran until getting stopped after %s, nice!", opts.BootTimeout)
+		return nil
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Unknown error, server failed")
+		report.Diagnose(stepRailsServer, so.savedOutput)
+		return fmt.Errorf("rails server failed")
 	}
 	logger.Warn("Rails server ran without error? That's unexpected.")
-	return false
+	return fmt.Errorf("rails server stopped without error")
 }
 
-func installVeracodeGem(repoFolder string, rubyVersion Version) error {
+// bootBindAddress is the address rails server listens on while testing.
+const bootBindAddress = "127.0.0.1"
+
+// freePort returns a port on bootBindAddress that is free right now.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(bootBindAddress, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func removeServerPidFile(repoFolder string) {
+	pidFile := filepath.Join(repoFolder, "tmp", "pids", "server.pid")
+	err := os.Remove(pidFile)
+	if err == nil {
+		logger.Infof("Removed stale %s", pidFile)
+	} else if !os.IsNotExist(err) {
+		logger.WithError(err).Warnf("Unable to remove %s", pidFile)
+	}
+}
+
+func installVeracodeGem(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string) error {
 	// TODO: What if rubyzip is already installed?
 	if rubyVersion.Major < 2 || (rubyVersion.Major == 2 && rubyVersion.Minor <= 4) {
-		cmd := exec.Command(
-			"rvm", rubyVersion.String()+"@veracode", "do",
-			"bundle", "add", "rubyzip",
+		cmd := bundleCommand(
+			rubyVersion, bundlerVersion,
+			"add", "rubyzip",
 			"--version", "~>1.0",
 			"--source", "https://rubygems.org",
 			"--skip-install")
 		cmd.Dir = repoFolder
-		cmd.Stdout = os.Stdout
+		cmd.Stdout = commandOutput
 		cmd.Stderr = os.Stderr
 
 		logger.Info("Ruby version < 2.4 detected, installing RubyZip 1.0")
 
-		err := cmd.Run()
+		err := runCommand(ctx, cmd)
 		if err != nil {
 			logger.WithError(err).Errorf("failed to rvm add rubyzip")
 			return fmt.Errorf("failed to bundle add rubyzip")
@@ -408,24 +698,24 @@ func installVeracodeGem(repoFolder string, rubyVersion Version) error {
 	}
 
 	logger.Info("Checking for existence of 'veracode' gem")
-	cmd2 := exec.Command(
-		"rvm", rubyVersion.String()+"@veracode", "do",
-		"bundle", "show", "veracode")
+	cmd2 := bundleCommand(
+		rubyVersion, bundlerVersion,
+		"show", "veracode")
 	cmd2.Dir = repoFolder
-	err := cmd2.Run()
+	err := runCommand(ctx, cmd2)
 
 	if err != nil {
 		logger.WithError(err).Errorf("bundle show veracode failed, assuming it's not installed yet")
 
 		logger.Info("Installing veracode gem with Bundler")
-		cmd := exec.Command(
-			"rvm", rubyVersion.String()+"@veracode", "do",
-			"bundle", "add", "veracode",
+		cmd := bundleCommand(
+			rubyVersion, bundlerVersion,
+			"add", "veracode",
 			"--source", "https://rubygems.org",
 			"--skip-install")
 		cmd.Dir = repoFolder
 
-		err = cmd.Run()
+		err = runCommand(ctx, cmd)
 		if err != nil {
 			logger.WithError(err).Errorf("failed to bundle add veracode")
 			return fmt.Errorf("failed to bundle add veracode")
@@ -437,19 +727,25 @@ func installVeracodeGem(repoFolder string, rubyVersion Version) error {
 	return nil
 }
 
-func runVeracodePrepare(repoFolder string, rubyVersion Version, railsEnv string) (string, error) {
+func runVeracodePrepare(ctx context.Context, repoFolder string, rubyVersion Version, bundlerVersion string, railsEnv string, opts Options, report *Report) (string, error) {
 	logger.Info("Running Veracode Prepare, this may take a while")
 
 	cmd := exec.Command("rvm", rubyVersion.String()+"@veracode", "do", "veracode", "prepare", "-vD")
 	cmd.Dir = repoFolder
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "RAILS_ENV="+railsEnv)
+	cmd.Env = appEnv(repoFolder, opts, railsEnv, bundlerVersion)
 	var so saveOutput
 	cmd.Stdout = &so
 	cmd.Stderr = &so
-	err := cmd.Run()
+	err := runLimited(ctx, cmd, stepVeracodePrepare, opts, opts.StepTimeout)
+	report.Prepare = parsePrepareOutput(repoFolder, so.savedOutput)
+	var limitErr *LimitExceededError
+	if errors.As(err, &limitErr) {
+		logger.WithError(err).Errorf("veracode prepare stopped for exceeding a limit")
+		return "", err
+	}
 	if err != nil {
 		logger.WithError(err).Errorf("failed to run veracode prepare")
+		report.Diagnose(stepVeracodePrepare, so.savedOutput)
 		return "", fmt.Errorf("failed run veracode prepare")
 	}
 
@@ -460,6 +756,7 @@ func runVeracodePrepare(repoFolder string, rubyVersion Version, railsEnv string)
 		return "", fmt.Errorf("did not find packaged file in veracode prepare output")
 	}
 
+	logPrepareResult(report.Prepare)
 	logger.Info("All done!")
 	return filepath.Join(repoFolder, veracodePrepareFile), nil
 }
@@ -482,7 +779,7 @@ func extractFilePath(output string) (string, error) {
 	return filePath, nil
 }
 
-func copyFile(packagedFile, outFile string) error {
+func copyFile(packagedFile, outFile string, force bool) error {
 	outFile, err := filepath.Abs(outFile)
 	if err != nil {
 		logger.WithError(err).Errorf("Unable to create absolute path for %s", outFile)
@@ -498,20 +795,12 @@ func copyFile(packagedFile, outFile string) error {
 	}
 	defer src.Close()
 
-	// Create or truncate the destination file
-	dst, err := os.Create(outFile)
-	if err != nil {
-		logger.WithError(err).Errorf("Error creating destination file %s", outFile)
-		return fmt.Errorf("error creating destination file: %s", outFile)
-	}
-	defer dst.Close()
-
-	// Copy the contents from source to destination
-	_, err = io.Copy(dst, src)
-	if err != nil {
-		logger.WithError(err).Errorf("Error copying file contents")
-		return fmt.Errorf("error copying file contents")
-	}
-
-	return nil
+	// Copy the contents to a temporary file that becomes outFile when complete
+	return writeOutFile(outFile, force, func(dst io.Writer) error {
+		if _, err := io.Copy(dst, src); err != nil {
+			logger.WithError(err).Errorf("Error copying file contents")
+			return fmt.Errorf("error copying file contents")
+		}
+		return nil
+	})
 }
@@ -0,0 +1,144 @@
+package vcrbpkg
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// PrepareResult is what veracode prepare did with the files of the
+// application, parsed from its verbose (-vD) output.
+type PrepareResult struct {
+	Compiled []string      `json:"compiled"`
+	Skipped  []SkippedFile `json:"skipped,omitempty"`
+	Errors   []FileError   `json:"errors,omitempty"`
+}
+
+// SkippedFile is a file veracode prepare did not compile.
+type SkippedFile struct {
+	File   string `json:"file"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// FileError is a file that raised an error while compiling.
+type FileError struct {
+	File    string `json:"file"`
+	Class   string `json:"class,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Lines in the verbose output of veracode prepare, optionally prefixed with
+// tags like [Rails] or [DEBUG]. The exact wording differs between versions of
+// the gem, so these are deliberately loose.
+var (
+	prepareLinePrefix    = `^\s*(?:\[[^\]]*\]\s*)*`
+	prepareCompiledRegex = regexp.MustCompile(`(?i)` + prepareLinePrefix +
+		`compil(?:ing|ed)(?: file)?\s*:?\s+['"]?([^\s'"]+\.\w+)['"]?\s*$`)
+	prepareSkippedRegex = regexp.MustCompile(`(?i)` + prepareLinePrefix +
+		`(?:skipp(?:ing|ed)|ignor(?:ing|ed))(?: file)?\s*:?\s+['"]?([^\s'"]+\.\w+)['"]?\s*(?:[:(,-]\s*(.*?)\)?)?\s*$`)
+	prepareErrorRegex = regexp.MustCompile(`(?i)` + prepareLinePrefix +
+		`(?:error(?: while)?(?: compiling)?|(?:unable to|failed to|could not) compile)(?: file)?\s*:?\s+['"]?([^\s'":]+\.\w+)['"]?\s*[:,-]?\s*(.*)$`)
+	// ErrorClass: message, or Ruby's message (ErrorClass)
+	errorClassPrefixRegex = regexp.MustCompile(`^\(?([A-Z]\w*(?:::[A-Z]\w*)*)\)?:\s*(.*)$`)
+	errorClassSuffixRegex = regexp.MustCompile(`^(.*?)\s*\(([A-Z]\w*(?:::[A-Z]\w*)*)\)$`)
+)
+
+// parsePrepareOutput collects the files veracode prepare compiled, skipped
+// and failed to compile, relative to repoFolder.
+func parsePrepareOutput(repoFolder string, output []byte) *PrepareResult {
+	compiled := map[string]bool{}
+	skipped := map[string]SkippedFile{}
+	errored := map[string]FileError{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := prepareErrorRegex.FindStringSubmatch(line); match != nil {
+			fileError := parseFileError(match[2])
+			fileError.File = relativeToApp(repoFolder, match[1])
+			errored[fileError.File] = fileError
+		} else if match := prepareSkippedRegex.FindStringSubmatch(line); match != nil {
+			file := relativeToApp(repoFolder, match[1])
+			skipped[file] = SkippedFile{File: file, Reason: strings.TrimSpace(match[2])}
+		} else if match := prepareCompiledRegex.FindStringSubmatch(line); match != nil {
+			compiled[relativeToApp(repoFolder, match[1])] = true
+		}
+	}
+
+	result := &PrepareResult{Compiled: []string{}}
+	for file := range compiled {
+		// A file that raised an error was not compiled after all
+		if _, failed := errored[file]; !failed {
+			result.Compiled = append(result.Compiled, file)
+		}
+	}
+	for file, skippedFile := range skipped {
+		if !compiled[file] {
+			result.Skipped = append(result.Skipped, skippedFile)
+		}
+	}
+	for _, fileError := range errored {
+		result.Errors = append(result.Errors, fileError)
+	}
+	sort.Strings(result.Compiled)
+	sort.Slice(result.Skipped, func(i, j int) bool { return result.Skipped[i].File < result.Skipped[j].File })
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].File < result.Errors[j].File })
+	return result
+}
+
+func parseFileError(rest string) FileError {
+	rest = strings.TrimSpace(rest)
+	if match := errorClassPrefixRegex.FindStringSubmatch(rest); match != nil {
+		return FileError{Class: match[1], Message: match[2]}
+	}
+	if match := errorClassSuffixRegex.FindStringSubmatch(rest); match != nil {
+		return FileError{Class: match[2], Message: match[1]}
+	}
+	return FileError{Message: rest}
+}
+
+// relativeToApp makes paths in the output relative to the application.
+func relativeToApp(repoFolder string, file string) string {
+	if !filepath.IsAbs(file) {
+		return filepath.ToSlash(filepath.Clean(file))
+	}
+	if absRepo, err := filepath.Abs(repoFolder); err == nil {
+		if relative, err := filepath.Rel(absRepo, file); err == nil && !strings.HasPrefix(relative, "..") {
+			return filepath.ToSlash(relative)
+		}
+	}
+	return file
+}
+
+// maxLoggedPrepareErrors is how many files with errors are listed in the
+// console, all of them are in the report.
+const maxLoggedPrepareErrors = 20
+
+// logPrepareResult prints a summary of the prepare result.
+func logPrepareResult(result *PrepareResult) {
+	logger.Infof("Veracode Prepare compiled %d file(s), skipped %d, %d raised errors",
+		len(result.Compiled), len(result.Skipped), len(result.Errors))
+	if len(result.Compiled) == 0 {
+		logger.Warn("No compiled files found in the veracode prepare output, Veracode may not see any of the application")
+	}
+	for i, fileError := range result.Errors {
+		if i == maxLoggedPrepareErrors {
+			logger.Warnf("... and %d more, see the report for all of them", len(result.Errors)-maxLoggedPrepareErrors)
+			break
+		}
+		if fileError.Class != "" {
+			logger.Warnf("Error compiling %s: %s: %s", fileError.File, fileError.Class, fileError.Message)
+		} else {
+			logger.Warnf("Error compiling %s: %s", fileError.File, fileError.Message)
+		}
+	}
+	for _, skipped := range result.Skipped {
+		logger.Debugf("Skipped %s %s", skipped.File, skipped.Reason)
+	}
+}
@@ -0,0 +1,24 @@
+package vcrbpkg
+
+import "os/exec"
+
+// Windows has no process groups we can signal, only the command itself is
+// stopped.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
+
+func terminateProcess(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
+
+func killProcess(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
@@ -0,0 +1,108 @@
+package vcrbpkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// Report is a machine readable summary of a packaging run, written to the
+// file given with --report.
+type Report struct {
+	Input          string      `json:"input"`
+	RepoFolder     string      `json:"repo_folder,omitempty"`
+	RubyVersion    string      `json:"ruby_version,omitempty"`
+	BundlerVersion string      `json:"bundler_version,omitempty"`
+	RailsEnv       string      `json:"rails_env,omitempty"`
+	PackagedFile   string      `json:"packaged_file,omitempty"`
+	Success        bool        `json:"success"`
+	Error          string      `json:"error,omitempty"`
+	Diagnoses      []Diagnosis `json:"diagnoses,omitempty"`
+	// Environments tried, in order.
+	Environments []EnvironmentOutcome `json:"environments,omitempty"`
+	// Prepare is what the last veracode prepare did with the files.
+	Prepare *PrepareResult `json:"prepare,omitempty"`
+	// Coverage of the Ruby files of the application by the package.
+	Coverage *Coverage `json:"coverage,omitempty"`
+	// Validation of the package.
+	Validation *Validation `json:"validation,omitempty"`
+	// Secrets found in the package.
+	Secrets *SecretScan `json:"secrets,omitempty"`
+	// Audit of the gems against ruby-advisory-db.
+	Audit *GemAudit `json:"audit,omitempty"`
+	// Export of the package to --out, with its checksum and manifest.
+	Export *Export `json:"export,omitempty"`
+	// DisabledAccelerators are the boot accelerators disabled for the run.
+	DisabledAccelerators []DisabledAccelerator `json:"disabled_accelerators,omitempty"`
+	// LimitsExceeded by the commands that were stopped.
+	LimitsExceeded []*LimitExceededError `json:"limits_exceeded,omitempty"`
+
+	knownFailures []KnownFailure
+}
+
+// Outcomes of the steps for a Rails environment.
+const (
+	outcomeOK      = "ok"
+	outcomeFailed  = "failed"
+	outcomeSkipped = "skipped"
+	// outcomeLimitExceeded is a step stopped for exceeding a limit.
+	outcomeLimitExceeded = "limit_exceeded"
+)
+
+// EnvironmentOutcome records how packaging in a Rails environment went.
+type EnvironmentOutcome struct {
+	RailsEnv      string `json:"rails_env"`
+	BundleInstall string `json:"bundle_install,omitempty"`
+	Boot          string `json:"boot,omitempty"`
+	Prepare       string `json:"prepare,omitempty"`
+	Error         string `json:"error,omitempty"`
+
+	packagedFile string
+	err          error
+}
+
+func newReport(input string, knownFailures []KnownFailure) *Report {
+	return &Report{Input: input, knownFailures: knownFailures}
+}
+
+// Diagnose looks for known failures in the output of a failed step, logs the
+// diagnosis with the suggested fix and adds them to the report.
+func (r *Report) Diagnose(step string, output []byte) {
+	diagnoses := diagnose(r.knownFailures, step, output)
+	if len(diagnoses) == 0 {
+		logger.Infof("No known cause found for failing %s, please check the output above", step)
+		return
+	}
+
+	for _, diagnosis := range diagnoses {
+		logger.Errorf("Known issue '%s' during %s: %s", diagnosis.ID, step, diagnosis.Diagnosis)
+		logger.Errorf("Suggested fix: %s", diagnosis.Fix)
+	}
+	r.Diagnoses = append(r.Diagnoses, diagnoses...)
+}
+
+func (r *Report) finish(err error) {
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func (r *Report) write(reportFile string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		logger.WithError(err).Error("Unable to encode report")
+		return fmt.Errorf("unable to encode report")
+	}
+
+	logger.Infof("Writing report to %s", reportFile)
+	// Secrets may show up in errors and the output in diagnoses
+	content = logger.Mask(content)
+	if err = os.WriteFile(reportFile, append(content, '\n'), 0644); err != nil {
+		logger.WithError(err).Errorf("Unable to write report to %s", reportFile)
+		return fmt.Errorf("unable to write report to %s", reportFile)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package vcrbpkg
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// SandboxCommand is the hidden vcrbpkg subcommand that sets up the sandbox
+// from inside before executing the actual command.
+const SandboxCommand = "__sandbox"
+
+// sandboxExitCode is used by the sandbox helper when setting up fails, before
+// the actual command runs.
+const sandboxExitCode = 125
+
+// sandboxConfig is what the sandbox helper sets up before executing the
+// command, passed to it as flags.
+type sandboxConfig struct {
+	isolateNetwork bool
+	// cgroup v2 directory to join, with the memory and process limits.
+	cgroup string
+	// rlimits to set, for the limits not enforced by the cgroup.
+	rlimits Limits
+}
+
+func (c sandboxConfig) args() []string {
+	var args []string
+	if c.isolateNetwork {
+		args = append(args, "--isolate-network")
+	}
+	if c.cgroup != "" {
+		args = append(args, "--cgroup", c.cgroup)
+	}
+	if c.rlimits.Memory > 0 {
+		args = append(args, "--max-memory", strconv.FormatUint(uint64(c.rlimits.Memory), 10))
+	}
+	if c.rlimits.CPUTime > 0 {
+		args = append(args, "--max-cpu-time", c.rlimits.CPUTime.String())
+	}
+	if c.rlimits.Processes > 0 {
+		args = append(args, "--max-processes", strconv.Itoa(c.rlimits.Processes))
+	}
+	return args
+}
+
+// parseSandboxArgs parses the flags from sandboxConfig.args, returning the
+// command after them.
+func parseSandboxArgs(args []string) (sandboxConfig, []string, error) {
+	var config sandboxConfig
+	var memory uint64
+	flags := flag.NewFlagSet(SandboxCommand, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.BoolVar(&config.isolateNetwork, "isolate-network", false, "")
+	flags.StringVar(&config.cgroup, "cgroup", "", "")
+	flags.Uint64Var(&memory, "max-memory", 0, "")
+	flags.DurationVar(&config.rlimits.CPUTime, "max-cpu-time", 0, "")
+	flags.IntVar(&config.rlimits.Processes, "max-processes", 0, "")
+	if err := flags.Parse(args); err != nil {
+		return config, nil, err
+	}
+	config.rlimits.Memory = ByteSize(memory)
+	return config, flags.Args(), nil
+}
+
+// sandbox is what applySandbox set up for a command. A nil sandbox means the
+// command does not run in a sandbox.
+type sandbox struct {
+	config sandboxConfig
+	limits Limits
+}
+
+// applySandbox makes cmd of step run in the sandbox configured in opts,
+// returning nil if nothing needs to be sandboxed. It should be called after
+// everything else about cmd has been set. bundle install keeps network access
+// to fetch the gems, only its resources are limited, checkSandbox warns about
+// that.
+func applySandbox(cmd *exec.Cmd, step string, opts Options) (*sandbox, error) {
+	limits := opts.limits()
+	isolate := opts.IsolateNetwork && step != stepBundleInstall
+	if !isolate && !limits.enabled() {
+		return nil, nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		logger.WithError(err).Error("Unable to find the vcrbpkg executable for the sandbox")
+		return nil, fmt.Errorf("unable to find the vcrbpkg executable for the sandbox")
+	}
+
+	sb := &sandbox{
+		config: sandboxConfig{isolateNetwork: isolate, rlimits: limits},
+		limits: limits,
+	}
+	if limits.Memory > 0 || limits.Processes > 0 {
+		// Without cgroup v2 the limits are enforced with rlimits, which was
+		// already logged by checkSandbox
+		if cgroup, err := createCgroup(limits); err == nil {
+			sb.config.cgroup = cgroup
+			sb.config.rlimits.Memory = 0
+			sb.config.rlimits.Processes = 0
+		}
+	}
+
+	// The helper receives the resolved path of the command, as the PATH of
+	// cmd.Env may differ from ours
+	args := append([]string{self, SandboxCommand}, sb.config.args()...)
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = self
+
+	if isolate {
+		if err := isolateNetwork(cmd); err != nil {
+			sb.close()
+			return nil, err
+		}
+	}
+	return sb, nil
+}
+
+// usesRlimits returns whether limits are enforced with rlimits, which can only
+// be recognized from the output of the command.
+func (sb *sandbox) usesRlimits() bool {
+	return sb != nil && (sb.config.rlimits.Memory > 0 || sb.config.rlimits.Processes > 0)
+}
+
+// exceeded returns the limit, and its value, the command failing with err and
+// output exceeded, if any.
+func (sb *sandbox) exceeded(err error, output []byte) (string, string) {
+	if sb == nil {
+		return "", ""
+	}
+	config := sb.config
+	if config.cgroup != "" {
+		memory, processes := cgroupLimitsHit(config.cgroup)
+		if memory {
+			return limitMaxMemory, sb.limits.Memory.String()
+		}
+		if processes {
+			return limitMaxProcesses, strconv.Itoa(sb.limits.Processes)
+		}
+	}
+	if config.rlimits.CPUTime > 0 && killedByCPULimit(err) {
+		return limitMaxCPUTime, sb.limits.CPUTime.String()
+	}
+	if config.rlimits.Memory > 0 && rlimitMemoryRegex.Match(output) {
+		return limitMaxMemory, sb.limits.Memory.String()
+	}
+	if config.rlimits.Processes > 0 && rlimitProcessesRegex.Match(output) {
+		return limitMaxProcesses, strconv.Itoa(sb.limits.Processes)
+	}
+	return "", ""
+}
+
+// close cleans up after the command ran.
+func (sb *sandbox) close() {
+	if sb != nil && sb.config.cgroup != "" {
+		removeCgroup(sb.config.cgroup)
+	}
+}
+
+// checkSandbox verifies the sandbox configured in opts can be set up on this
+// system, so we fail early with a clear error instead of on every command.
+func checkSandbox(ctx context.Context, opts Options) error {
+	limits := opts.limits()
+	if !opts.IsolateNetwork && !limits.enabled() {
+		return nil
+	}
+
+	if opts.IsolateNetwork {
+		if err := networkIsolationSupported(); err != nil {
+			return err
+		}
+		logger.Warn("--isolate-network does not apply to bundle install, which fetches the gems: the native extensions of the gems in the Gemfile are built with network access")
+	}
+
+	if limits.Memory > 0 || limits.Processes > 0 {
+		base, err := cgroupBase()
+		if err != nil {
+			logger.WithError(err).Warn("cgroup v2 not available, using rlimits instead: max_memory limits the virtual memory of each process and max_processes all processes of our user")
+			if limits.Processes > 0 && os.Geteuid() == 0 {
+				logger.Warn("max_processes is not enforced with rlimits when running as root")
+			}
+		} else {
+			logger.Infof("Limiting memory and processes with cgroup v2 in %s", base)
+		}
+	}
+
+	cmd := exec.Command("true")
+	sb, err := applySandbox(cmd, "", opts)
+	if err != nil {
+		return err
+	}
+	defer sb.close()
+	output, err := outputCommand(ctx, cmd)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to run a command in the sandbox: %s", strings.TrimSpace(string(output)))
+		return fmt.Errorf("unable to set up the sandbox: %s", strings.TrimSpace(string(output)))
+	}
+	if opts.IsolateNetwork {
+		logger.Info("Booting the application without network access, only loopback is available")
+	}
+	return nil
+}
+
+// SandboxExec is run by the sandbox helper inside the sandbox. It finishes
+// setting up the sandbox and replaces itself with the command in args.
+func SandboxExec(args []string) {
+	config, args, err := parseSandboxArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcrbpkg sandbox: %v\n", err)
+		os.Exit(sandboxExitCode)
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "vcrbpkg sandbox: no command to run")
+		os.Exit(sandboxExitCode)
+	}
+
+	if err := setupSandbox(config); err != nil {
+		fmt.Fprintf(os.Stderr, "vcrbpkg sandbox: %v\n", err)
+		os.Exit(sandboxExitCode)
+	}
+
+	if err := execCommand(args); err != nil {
+		fmt.Fprintf(os.Stderr, "vcrbpkg sandbox: unable to run %s: %v\n", args[0], err)
+		os.Exit(sandboxExitCode)
+	}
+}
@@ -0,0 +1,117 @@
+package vcrbpkg
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/capability.h and linux/prctl.h
+const (
+	capNetAdmin           = 12
+	prCapAmbient          = 47
+	prCapAmbientClearAll  = 4
+	unprivilegedUsernsMsg = "unprivileged user namespaces are not available, run vcrbpkg as root or allow them with 'sysctl kernel.unprivileged_userns_clone=1' or 'sysctl user.max_user_namespaces=15000'"
+)
+
+// isolateNetwork runs cmd in a new network namespace, which only has a
+// loopback interface. When not running as root this needs a new user
+// namespace as well, mapping our own user, with just enough privileges for
+// the sandbox helper to bring up the loopback interface.
+func isolateNetwork(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	cmd.SysProcAttr.AmbientCaps = []uintptr{capNetAdmin}
+	return nil
+}
+
+// networkIsolationSupported checks the kernel settings that disable
+// unprivileged user namespaces.
+func networkIsolationSupported() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	for _, setting := range []string{"/proc/sys/kernel/unprivileged_userns_clone", "/proc/sys/user/max_user_namespaces"} {
+		content, err := os.ReadFile(setting)
+		if err == nil && strings.TrimSpace(string(content)) == "0" {
+			return fmt.Errorf("unable to isolate the network: %s (%s is 0)", unprivilegedUsernsMsg, setting)
+		}
+	}
+	return nil
+}
+
+// setupSandbox joins the cgroup and sets the rlimits for the command. In a
+// new network namespace it brings up the loopback interface and drops the
+// capabilities that were only needed for that.
+func setupSandbox(config sandboxConfig) error {
+	if config.cgroup != "" {
+		if err := joinCgroup(config.cgroup); err != nil {
+			return err
+		}
+	}
+
+	if err := setRlimits(config.rlimits); err != nil {
+		return err
+	}
+
+	if !config.isolateNetwork {
+		return nil
+	}
+
+	if err := bringUpLoopback(); err != nil {
+		return fmt.Errorf("unable to bring up loopback interface in network namespace: %v (%s)", err, unprivilegedUsernsMsg)
+	}
+
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 && os.Geteuid() != 0 {
+		return fmt.Errorf("unable to drop capabilities: %v", errno)
+	}
+	return nil
+}
+
+func bringUpLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq with ifr_flags
+	var ifreq struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifreq.name[:], "lo")
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return errno
+	}
+	ifreq.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func execCommand(args []string) error {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, args, os.Environ())
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package vcrbpkg
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errSandboxUnsupported = errors.New("network isolation and resource limits are only supported on Linux")
+
+func isolateNetwork(cmd *exec.Cmd) error {
+	return errSandboxUnsupported
+}
+
+func networkIsolationSupported() error {
+	return errSandboxUnsupported
+}
+
+func setupSandbox(config sandboxConfig) error {
+	return errSandboxUnsupported
+}
+
+func execCommand(args []string) error {
+	return errSandboxUnsupported
+}
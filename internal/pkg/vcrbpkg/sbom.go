@@ -0,0 +1,404 @@
+package vcrbpkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// cycloneDXSpecVersion is the version of CycloneDX of the SBOMs.
+const cycloneDXSpecVersion = "1.5"
+
+// BOM is a CycloneDX JSON software bill of materials (SBOM) of the gems of
+// an application.
+type BOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     BOMMetadata     `json:"metadata"`
+	Components   []BOMComponent  `json:"components"`
+	Dependencies []BOMDependency `json:"dependencies"`
+}
+
+// BOMMetadata describes when, how and for which application the SBOM was
+// made.
+type BOMMetadata struct {
+	Timestamp time.Time `json:"timestamp"`
+	Tools     struct {
+		Components []BOMComponent `json:"components"`
+	} `json:"tools"`
+	Component BOMComponent `json:"component"`
+}
+
+// BOMComponent is the application, a gem or vcrbpkg itself.
+type BOMComponent struct {
+	Type               string                 `json:"type"`
+	BOMRef             string                 `json:"bom-ref,omitempty"`
+	Name               string                 `json:"name"`
+	Version            string                 `json:"version,omitempty"`
+	Description        string                 `json:"description,omitempty"`
+	PURL               string                 `json:"purl,omitempty"`
+	Licenses           []BOMLicense           `json:"licenses,omitempty"`
+	ExternalReferences []BOMExternalReference `json:"externalReferences,omitempty"`
+	Properties         []BOMProperty          `json:"properties,omitempty"`
+}
+
+// BOMLicense is an SPDX license ID, or the name of other licenses.
+type BOMLicense struct {
+	License struct {
+		ID   string `json:"id,omitempty"`
+		Name string `json:"name,omitempty"`
+	} `json:"license"`
+}
+
+// BOMExternalReference is a link like the homepage or repository of a gem.
+type BOMExternalReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// BOMProperty is a name and value for what CycloneDX has no field for, like
+// the git revision of a gem.
+type BOMProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// BOMDependency lists the components a component depends on.
+type BOMDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// spdxLicenses are the SPDX IDs of licenses common for gems, others are
+// recorded by name.
+var spdxLicenses = map[string]bool{
+	"0BSD": true, "Apache-2.0": true, "Artistic-2.0": true, "BSD-2-Clause": true, "BSD-3-Clause": true,
+	"BSL-1.0": true, "CC0-1.0": true, "GPL-2.0": true, "GPL-2.0-only": true, "GPL-2.0-or-later": true,
+	"GPL-3.0": true, "GPL-3.0-only": true, "GPL-3.0-or-later": true, "ISC": true, "LGPL-2.1": true,
+	"LGPL-2.1-only": true, "LGPL-2.1-or-later": true, "LGPL-3.0": true, "LGPL-3.0-only": true,
+	"LGPL-3.0-or-later": true, "MIT": true, "MPL-2.0": true, "Ruby": true, "Unlicense": true,
+	"WTFPL": true, "Zlib": true,
+}
+
+// installedGem is the metadata of an installed gem from its gemspec.
+type installedGem struct {
+	Licenses []string
+	Summary  string
+	Homepage string
+}
+
+var (
+	gemspecLicensesRegex = regexp.MustCompile(`(?m)^\s*\w+\.licenses?\s*=\s*(.+)$`)
+	gemspecSummaryRegex  = regexp.MustCompile(`(?m)^\s*\w+\.summary\s*=\s*"((?:[^"\\]|\\.)*)"`)
+	gemspecHomepageRegex = regexp.MustCompile(`(?m)^\s*\w+\.homepage\s*=\s*"([^"]*)"`)
+	gemspecStringRegex   = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"|'([^']*)'`)
+)
+
+// parseGemspec reads the licenses, summary and homepage from gemspec, as
+// written in the specifications directory when installing a gem.
+func parseGemspec(file string) (installedGem, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return installedGem{}, err
+	}
+
+	var gem installedGem
+	if match := gemspecLicensesRegex.FindSubmatch(content); match != nil {
+		for _, quoted := range gemspecStringRegex.FindAllSubmatch(match[1], -1) {
+			gem.Licenses = append(gem.Licenses, string(quoted[1])+string(quoted[2]))
+		}
+	}
+	if match := gemspecSummaryRegex.FindSubmatch(content); match != nil {
+		gem.Summary = strings.ReplaceAll(string(match[1]), `\"`, `"`)
+	}
+	if match := gemspecHomepageRegex.FindSubmatch(content); match != nil {
+		gem.Homepage = string(match[1])
+	}
+	return gem, nil
+}
+
+// findInstalledGem returns the metadata of gem installed in one of gemPaths,
+// from the gemspec in specifications for released gems or in bundler/gems
+// for gems from git.
+func findInstalledGem(gemPaths []string, gem LockedGem) (installedGem, bool) {
+	names := []string{gem.Name + "-" + gem.Version}
+	if gem.Platform != "" {
+		names = append([]string{gem.Name + "-" + gem.Version + "-" + gem.Platform}, names...)
+	}
+	for _, gemPath := range gemPaths {
+		var candidates []string
+		for _, name := range names {
+			candidates = append(candidates, filepath.Join(gemPath, "specifications", name+".gemspec"))
+		}
+		if gem.Source.Type == "GIT" && len(gem.Source.Revision) >= 12 {
+			// Bundler checks out git gems as <repository>-<revision[0:12]>
+			checkouts, _ := filepath.Glob(filepath.Join(gemPath, "bundler", "gems", "*-"+gem.Source.Revision[:12]))
+			for _, checkout := range checkouts {
+				candidates = append(candidates, filepath.Join(checkout, gem.Name+".gemspec"))
+			}
+		}
+		for _, candidate := range candidates {
+			if installed, err := parseGemspec(candidate); err == nil {
+				return installed, true
+			}
+		}
+	}
+	return installedGem{}, false
+}
+
+// installedGemPaths returns the gem paths of the veracode gemset of
+// rubyVersion, or of the gem command on the PATH without RVM.
+func installedGemPaths(ctx context.Context, repoFolder string, rubyVersion Version) []string {
+	commands := []*exec.Cmd{
+		exec.Command("rvm", rubyVersion.String()+"@veracode", "do", "gem", "env", "gempath"),
+		exec.Command("gem", "env", "gempath"),
+	}
+	for _, cmd := range commands {
+		cmd.Dir = repoFolder
+		output, err := outputCommand(ctx, cmd)
+		if err != nil {
+			logger.WithError(err).Debugf("Unable to find installed gems with %s", strings.Join(cmd.Args, " "))
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return filepath.SplitList(strings.TrimSpace(lines[len(lines)-1]))
+	}
+	return nil
+}
+
+// gemPURL returns the package URL of gem, with the platform of native gems and
+// the repository and revision of gems from git.
+func gemPURL(gem LockedGem) string {
+	purl := "pkg:gem/" + url.PathEscape(gem.Name) + "@" + url.PathEscape(gem.Version)
+	var qualifiers []string
+	if gem.Platform != "" {
+		qualifiers = append(qualifiers, "platform="+url.QueryEscape(gem.Platform))
+	}
+	switch gem.Source.Type {
+	case "GIT":
+		vcsURL := "git+" + urlCredentialsRegex.ReplaceAllString(gem.Source.Remote, "://")
+		if gem.Source.Revision != "" {
+			vcsURL += "@" + gem.Source.Revision
+		}
+		qualifiers = append(qualifiers, "vcs_url="+url.QueryEscape(vcsURL))
+	case "GEM":
+		if remote := strings.TrimSuffix(gem.Source.Remote, "/"); remote != "" && remote != "https://rubygems.org" {
+			qualifiers = append(qualifiers, "repository_url="+url.QueryEscape(urlCredentialsRegex.ReplaceAllString(remote, "://")))
+		}
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+// newBOMComponent returns the component of a locked gem, with the metadata of
+// the installed gem if found.
+func newBOMComponent(gem LockedGem, installed installedGem) BOMComponent {
+	purl := gemPURL(gem)
+	component := BOMComponent{
+		Type:        "library",
+		BOMRef:      purl,
+		Name:        gem.Name,
+		Version:     gem.Version,
+		Description: installed.Summary,
+		PURL:        purl,
+	}
+	for _, name := range installed.Licenses {
+		var license BOMLicense
+		if spdxLicenses[name] {
+			license.License.ID = name
+		} else {
+			license.License.Name = name
+		}
+		component.Licenses = append(component.Licenses, license)
+	}
+	if installed.Homepage != "" {
+		component.ExternalReferences = append(component.ExternalReferences, BOMExternalReference{Type: "website", URL: installed.Homepage})
+	}
+
+	source := map[string]string{"GEM": "rubygems", "GIT": "git", "PATH": "path", "PLUGIN SOURCE": "plugin"}[gem.Source.Type]
+	if source != "" {
+		component.Properties = append(component.Properties, BOMProperty{Name: "vcrbpkg:gem:source", Value: source})
+	}
+	switch gem.Source.Type {
+	case "GIT":
+		remote := urlCredentialsRegex.ReplaceAllString(gem.Source.Remote, "://")
+		component.ExternalReferences = append(component.ExternalReferences, BOMExternalReference{Type: "vcs", URL: remote})
+		for _, property := range []BOMProperty{
+			{Name: "vcrbpkg:git:revision", Value: gem.Source.Revision},
+			{Name: "vcrbpkg:git:branch", Value: gem.Source.Branch},
+			{Name: "vcrbpkg:git:tag", Value: gem.Source.Tag},
+			{Name: "vcrbpkg:git:ref", Value: gem.Source.Ref},
+		} {
+			if property.Value != "" {
+				component.Properties = append(component.Properties, property)
+			}
+		}
+	case "PATH":
+		component.Properties = append(component.Properties, BOMProperty{Name: "vcrbpkg:path", Value: gem.Source.Remote})
+	}
+	if gem.Platform != "" {
+		component.Properties = append(component.Properties, BOMProperty{Name: "vcrbpkg:gem:platform", Value: gem.Platform})
+	}
+	return component
+}
+
+// GenerateSBOM returns the SBOM of the gems in the Gemfile.lock of repoFolder,
+// with licenses and descriptions of the gems installed in gemPaths. name and
+// version describe the application.
+func GenerateSBOM(repoFolder string, name string, version string, gemPaths []string) (*BOM, error) {
+	lockfile, err := parseLockfile(repoFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	sbom := &BOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  cycloneDXSpecVersion,
+		SerialNumber: newSerialNumber(),
+		Version:      1,
+		Components:   []BOMComponent{},
+		Dependencies: []BOMDependency{},
+	}
+	sbom.Metadata.Timestamp = time.Now().UTC().Truncate(time.Second)
+	sbom.Metadata.Tools.Components = []BOMComponent{{Type: "application", Name: "vcrbpkg", Version: BuildVersion()}}
+	sbom.Metadata.Component = BOMComponent{Type: "application", BOMRef: name, Name: name, Version: version}
+
+	// A gem can be locked for several platforms, dependencies are on all of them
+	refs := map[string][]string{}
+	missing := 0
+	for _, gem := range lockfile.Gems {
+		installed, found := findInstalledGem(gemPaths, gem)
+		if !found {
+			missing++
+		}
+		component := newBOMComponent(gem, installed)
+		sbom.Components = append(sbom.Components, component)
+		refs[gem.Name] = append(refs[gem.Name], component.BOMRef)
+	}
+	if missing > 0 {
+		logger.Warnf("No installed metadata for %d of %d gems, their licenses are not in the SBOM", missing, len(lockfile.Gems))
+	}
+
+	dependsOn := func(dependencies []GemDependency) []string {
+		ids := []string{}
+		for _, dependency := range dependencies {
+			ids = append(ids, refs[dependency.Name]...)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	sbom.Dependencies = append(sbom.Dependencies, BOMDependency{Ref: name, DependsOn: dependsOn(lockfile.Dependencies)})
+	for i, gem := range lockfile.Gems {
+		sbom.Dependencies = append(sbom.Dependencies, BOMDependency{Ref: sbom.Components[i].BOMRef, DependsOn: dependsOn(gem.Dependencies)})
+	}
+	return sbom, nil
+}
+
+// newSerialNumber returns a random UUID URN to identify the SBOM.
+func newSerialNumber() string {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		panic(err)
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// sbomFile returns the SBOM next to the package, like railsgoat.cdx.json for
+// railsgoat.zip.
+func sbomFile(packageFile string) string {
+	return strings.TrimSuffix(packageFile, filepath.Ext(packageFile)) + ".cdx.json"
+}
+
+// generateSBOM returns the encoded SBOM of the application for
+// exportPackage to write next to the package, or nil when opts.SBOM is off or
+// the package is not exported to a file.
+func generateSBOM(ctx context.Context, input string, repoFolder string, rubyVersion Version, opts Options) ([]byte, error) {
+	if !opts.SBOM || opts.OutFile == stdoutFile {
+		logger.Debug("Not writing an SBOM, it is turned off or the package is not exported to a file")
+		return nil, nil
+	}
+
+	sbom, err := GenerateSBOM(repoFolder, repoName(input, repoFolder), gitCommit(ctx, repoFolder), installedGemPaths(ctx, repoFolder, rubyVersion))
+	if err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	if err := encodeSBOM(&content, sbom); err != nil {
+		return nil, err
+	}
+	logger.Infof("Generated SBOM of %d gems", len(sbom.Components))
+	return content.Bytes(), nil
+}
+
+func encodeSBOM(w io.Writer, sbom *BOM) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(sbom); err != nil {
+		return fmt.Errorf("unable to write SBOM: %v", err)
+	}
+	return nil
+}
+
+// gitCommit returns the commit checked out in repoFolder, empty outside a git
+// checkout.
+func gitCommit(ctx context.Context, repoFolder string) string {
+	output, err := outputCommand(ctx, exec.Command("git", "-C", repoFolder, "rev-parse", "HEAD"))
+	if err != nil {
+		logger.Debugf("No commit, %s is not a git checkout", repoFolder)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// SBOM writes the SBOM of the application in args (the current
+// directory by default) to out, or stdout, without packaging it. Installed
+// gems are looked up in gemPaths, or the veracode gemset by default.
+func SBOM(ctx context.Context, args []string, out string, gemPaths []string, force bool) error {
+	repoFolder := "."
+	if len(args) > 0 {
+		repoFolder = args[0]
+	}
+	if out == "" || out == stdoutFile {
+		outputToStderr()
+	} else if err := checkOverwrite(out, force); err != nil {
+		return err
+	}
+
+	if len(gemPaths) == 0 {
+		gemPaths = installedGemPaths(ctx, repoFolder, determineRubyVersion(repoFolder))
+	}
+	logger.Debugf("Looking for installed gems in %s", strings.Join(gemPaths, string(filepath.ListSeparator)))
+	sbom, err := GenerateSBOM(repoFolder, repoName(repoFolder, repoFolder), gitCommit(ctx, repoFolder), gemPaths)
+	if err != nil {
+		return err
+	}
+
+	if out == "" || out == stdoutFile {
+		return encodeSBOM(os.Stdout, sbom)
+	}
+	if err := writeOutFile(out, force, func(w io.Writer) error { return encodeSBOM(w, sbom) }); err != nil {
+		return err
+	}
+	logger.Infof("Wrote SBOM of %d gems to %s", len(sbom.Components), out)
+	return nil
+}
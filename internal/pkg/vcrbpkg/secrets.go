@@ -0,0 +1,275 @@
+package vcrbpkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// secretScheme prefixes values in env that are resolved by a SecretProvider,
+// like secret://file/run/secrets/db_password.
+const secretScheme = "secret://"
+
+// SecretProvider resolves the reference in secret://<provider>/<reference>.
+type SecretProvider interface {
+	Resolve(ctx context.Context, reference string) (string, error)
+}
+
+// secretProviders returns the providers by name, configured from opts.
+func secretProviders(opts Options) map[string]SecretProvider {
+	return map[string]SecretProvider{
+		"file":    fileSecrets{},
+		"env":     envSecrets{},
+		"command": commandSecrets{command: strings.Fields(opts.SecretCommand)},
+		"vault":   vaultSecrets{addr: opts.VaultAddr, client: &http.Client{Timeout: 10 * time.Second}},
+	}
+}
+
+// secretProviderNames are the providers that can be used in references.
+var secretProviderNames = []string{"command", "env", "file", "vault"}
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretScheme)
+}
+
+// parseSecretRef splits secret://<provider>/<reference>.
+func parseSecretRef(value string) (string, string, error) {
+	provider, reference, _ := strings.Cut(strings.TrimPrefix(value, secretScheme), "/")
+	known := false
+	for _, name := range secretProviderNames {
+		known = known || name == provider
+	}
+	if !known {
+		return "", "", fmt.Errorf("unknown secret provider '%s' in %s, expected one of: %s", provider, value, strings.Join(secretProviderNames, ", "))
+	}
+	if reference == "" {
+		return "", "", fmt.Errorf("missing reference in %s, expected secret://%s/<reference>", value, provider)
+	}
+	return provider, reference, nil
+}
+
+// resolveSecrets replaces the secret references in opts.Env and
+// opts.SignPassword by their values, which are masked in all logs and reports
+// from then on. The values are only passed to the commands in their
+// environment.
+func resolveSecrets(ctx context.Context, opts *Options) error {
+	if opts.SignPassword != "" {
+		if isSecretRef(opts.SignPassword) {
+			provider, reference, err := parseSecretRef(opts.SignPassword)
+			if err != nil {
+				return err
+			}
+			logger.Infof("Resolving sign_password from %s", opts.SignPassword)
+			value, err := secretProviders(*opts)[provider].Resolve(ctx, reference)
+			if err != nil {
+				logger.WithError(err).Error("Unable to resolve secret for sign_password")
+				return fmt.Errorf("unable to resolve secret for sign_password from %s: %v", opts.SignPassword, err)
+			}
+			opts.SignPassword = value
+		}
+		logger.AddMask(opts.SignPassword)
+	}
+
+	var names []string
+	for name, value := range opts.Env {
+		if isSecretRef(value) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	providers := secretProviders(*opts)
+	env := map[string]string{}
+	for name, value := range opts.Env {
+		env[name] = value
+	}
+	for _, name := range names {
+		provider, reference, err := parseSecretRef(opts.Env[name])
+		if err != nil {
+			return err
+		}
+		logger.Infof("Resolving env %s from %s", name, opts.Env[name])
+		value, err := providers[provider].Resolve(ctx, reference)
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to resolve secret for env %s", name)
+			return fmt.Errorf("unable to resolve secret for env %s from %s: %v", name, opts.Env[name], err)
+		}
+		logger.AddMask(value)
+		env[name] = value
+	}
+	opts.Env = env
+	return nil
+}
+
+// fileSecrets reads the secret from a file, like secret://file/run/secrets/x
+// for /run/secrets/x.
+type fileSecrets struct{}
+
+func (fileSecrets) Resolve(ctx context.Context, reference string) (string, error) {
+	content, err := os.ReadFile(filepath.FromSlash("/" + reference))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// envSecrets reads the secret from our own environment, for use with
+// hermetic mode where it is not passed on otherwise.
+type envSecrets struct{}
+
+func (envSecrets) Resolve(ctx context.Context, reference string) (string, error) {
+	value, found := os.LookupEnv(reference)
+	if !found {
+		return "", fmt.Errorf("environment variable %s is not set", reference)
+	}
+	return value, nil
+}
+
+// commandSecrets runs the configured secret_command with the reference as
+// last argument, the secret is what it prints on stdout.
+type commandSecrets struct {
+	command []string
+}
+
+func (c commandSecrets) Resolve(ctx context.Context, reference string) (string, error) {
+	if len(c.command) == 0 {
+		return "", errors.New("secret_command is not configured")
+	}
+
+	args := append(append([]string(nil), c.command[1:]...), reference)
+	cmd := exec.Command(c.command[0], args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// In the foreground, as commands like pass may ask for a passphrase
+	if err := runForegroundCommand(ctx, cmd); err != nil {
+		return "", fmt.Errorf("%s failed: %v: %s", c.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// vaultSecrets reads the secret from a HashiCorp Vault compatible HTTP API,
+// like secret://vault/secret/data/myapp#db_password for the db_password field
+// of secret/data/myapp. The token is taken from VAULT_TOKEN or ~/.vault-token,
+// a local Vault agent may not need one. Only a Vault on a loopback address is
+// used, so the token is never sent elsewhere.
+type vaultSecrets struct {
+	addr   string
+	client *http.Client
+}
+
+const defaultVaultAddr = "http://127.0.0.1:8200"
+
+func (v vaultSecrets) Resolve(ctx context.Context, reference string) (string, error) {
+	path, field, found := strings.Cut(reference, "#")
+	if !found || field == "" {
+		return "", errors.New("missing field, expected secret://vault/<path>#<field>")
+	}
+
+	addr := v.addr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		addr = defaultVaultAddr
+	}
+	// Only a local Vault (agent) gets the token of the user
+	if err := checkLoopbackAddr(addr); err != nil {
+		return "", err
+	}
+	endpoint, err := url.JoinPath(addr, "v1", path)
+	if err != nil {
+		return "", fmt.Errorf("invalid vault address %s: %v", addr, err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	if token := vaultToken(); token != "" {
+		logger.AddMask(token)
+		request.Header.Set("X-Vault-Token", token)
+	}
+
+	response, err := v.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", endpoint, response.Status)
+	}
+
+	// KV version 2 nests the secret in data.data, version 1 has it in data
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("unable to decode response from %s: %v", endpoint, err)
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, isV1 := data[field]; !isV1 {
+			data = nested
+		}
+	}
+	value, found := data[field]
+	if !found {
+		return "", fmt.Errorf("field %s not found in %s", field, path)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+// checkLoopbackAddr returns an error unless addr is an http(s) URL on
+// localhost or a loopback address.
+func checkLoopbackAddr(addr string) error {
+	parsed, err := url.Parse(addr)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid vault address %s, expected a URL like %s", addr, defaultVaultAddr)
+	}
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("vault address %s is not local, only localhost and loopback addresses are allowed", addr)
+	}
+	return nil
+}
+
+func vaultToken() string {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	token, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(token))
+}
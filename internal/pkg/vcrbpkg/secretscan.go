@@ -0,0 +1,427 @@
+package vcrbpkg
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// ExitSecretsFound is the exit code when secrets are found in the package
+// with --on-secret=fail, or could not be stripped.
+const ExitSecretsFound = 6
+
+// Policies for secrets found in the package.
+const (
+	// OnSecretOff skips scanning.
+	OnSecretOff = "off"
+	// OnSecretWarn only logs the secrets found.
+	OnSecretWarn = "warn"
+	// OnSecretFail fails the run.
+	OnSecretFail = "fail"
+	// OnSecretStrip rewrites the package without the entries with secrets.
+	OnSecretStrip = "strip"
+)
+
+var onSecretPolicies = []string{OnSecretOff, OnSecretWarn, OnSecretFail, OnSecretStrip}
+
+// secretRule matches credentials in the content of a file.
+type secretRule struct {
+	id          string
+	description string
+	re          *regexp.Regexp
+}
+
+var secretRules = []secretRule{
+	{"private-key", "private key", regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`)},
+	{"aws-access-key-id", "AWS access key ID", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github-token", "GitHub token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{60,})\b`)},
+	{"gitlab-token", "GitLab token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`)},
+	{"slack-token", "Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"slack-webhook", "Slack webhook", regexp.MustCompile(`https://hooks\.slack\.com/services/[A-Za-z0-9/]{20,}`)},
+	{"stripe-key", "Stripe secret key", regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{20,}`)},
+	{"google-api-key", "Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"sendgrid-key", "SendGrid API key", regexp.MustCompile(`\bSG\.[A-Za-z0-9_-]{22}\.[A-Za-z0-9_-]{43}\b`)},
+	{"url-credentials", "password in URL", regexp.MustCompile(`\b[a-z][a-z0-9+.-]*://[^\s:/@'"]+:[^\s/@'"]{3,}@[^\s'"]+`)},
+	{"secret-assignment", "hard coded secret", regexp.MustCompile(
+		`(?i)\b(?:` + secretNames + `)['"]?\s*(?::|=>|=)\s*['"]([^'"\s<#{}]{12,})['"]`)},
+	{"secret-yaml", "hard coded secret", regexp.MustCompile(
+		`(?i)^\s*(?:` + secretNames + `)\s*:\s*([A-Za-z0-9+/=_-]{16,})\s*$`)},
+}
+
+// secretNames are names of keys and variables that hold secrets.
+const secretNames = `secret_key_base|secret_token|password|passwd|api_key|apikey|access_key|secret_key|private_key|auth_token`
+
+// secretFileRule matches files that hold credentials by their name.
+type secretFileRule struct {
+	id          string
+	description string
+	re          *regexp.Regexp
+}
+
+var secretFileRules = []secretFileRule{
+	{"rails-master-key", "Rails master key", regexp.MustCompile(`(^|/)config/(master|credentials/[^/]+)\.key$`)},
+	{"env-file", "environment file", regexp.MustCompile(`(^|/)\.env(\.[^/]*)?$`)},
+	{"ssh-key", "SSH private key", regexp.MustCompile(`(^|/)id_(rsa|dsa|ecdsa|ed25519)$`)},
+	{"key-store", "key or key store", regexp.MustCompile(`\.(pem|key|p12|pfx|jks|keystore)$`)},
+	{"netrc", "credentials file", regexp.MustCompile(`(^|/)(\.netrc|\.npmrc|\.pgpass|\.git-credentials)$`)},
+}
+
+// maxScannedSize is the largest file scanned for secrets.
+const maxScannedSize = 64 << 20
+
+// SecretScan is the result of scanning a package for secrets.
+type SecretScan struct {
+	File     string          `json:"file"`
+	Findings []SecretFinding `json:"findings"`
+	// Stripped are the entries removed from the package.
+	Stripped []string `json:"stripped,omitempty"`
+}
+
+// SecretFinding is a secret found in the package. Match only shows the start
+// of the secret.
+type SecretFinding struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+	// Entry in the package, or Source file compiled into it.
+	Entry  string `json:"entry,omitempty"`
+	Source string `json:"source,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Match  string `json:"match,omitempty"`
+	// Compiled is set when the entry holds compiled code, which can not be
+	// stripped without losing the code.
+	Compiled bool `json:"compiled,omitempty"`
+}
+
+// SecretsFoundError is returned when secrets are found in the package.
+type SecretsFoundError struct {
+	File     string
+	Findings int
+	Reason   string
+}
+
+func (e *SecretsFoundError) Error() string {
+	return fmt.Sprintf("found %d secret(s) in package %s%s", e.Findings, e.File, e.Reason)
+}
+
+// ExitCode makes vcrbpkg exit with ExitSecretsFound.
+func (e *SecretsFoundError) ExitCode() int {
+	return ExitSecretsFound
+}
+
+// compileSecretPatterns adds the custom patterns to the built-in rules.
+func compileSecretPatterns(patterns []string) ([]secretRule, error) {
+	rules := append([]secretRule{}, secretRules...)
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret pattern '%s': %v", pattern, err)
+		}
+		rules = append(rules, secretRule{id: fmt.Sprintf("custom-%d", i+1), description: "custom pattern", re: re})
+	}
+	return rules, nil
+}
+
+// ScanPackage scans the entries of the package at file, and the source files
+// compiled into it that exist on this machine, for secrets.
+func ScanPackage(file string, patterns []string) (*SecretScan, error) {
+	rules, err := compileSecretPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := zip.OpenReader(file)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to open package %s as zip", file)
+		return nil, fmt.Errorf("unable to open package %s as zip: %v", file, err)
+	}
+	defer reader.Close()
+
+	scan := &SecretScan{File: file, Findings: []SecretFinding{}}
+	sources := map[string]bool{}
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		for _, rule := range secretFileRules {
+			if rule.re.MatchString(f.Name) {
+				scan.Findings = append(scan.Findings, SecretFinding{Rule: rule.id, Description: rule.description, Entry: f.Name})
+				break
+			}
+		}
+		if f.UncompressedSize64 > maxScannedSize {
+			logger.Debugf("Not scanning %s for secrets, it is larger than %s", f.Name, humanSize(maxScannedSize))
+			continue
+		}
+
+		entry, err := f.Open()
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to read %s in package %s", f.Name, file)
+			return nil, fmt.Errorf("unable to read %s in package %s: %v", f.Name, file, err)
+		}
+		findings, compiled, err := scanContent(entry, rules, sources)
+		entry.Close()
+		if err != nil {
+			logger.WithError(err).Errorf("Unable to read %s in package %s", f.Name, file)
+			return nil, fmt.Errorf("unable to read %s in package %s: %v", f.Name, file, err)
+		}
+		for _, finding := range findings {
+			finding.Entry = f.Name
+			finding.Compiled = compiled
+			scan.Findings = append(scan.Findings, finding)
+		}
+	}
+
+	for _, source := range sortedKeys(sources) {
+		scan.Findings = append(scan.Findings, scanSource(source, rules)...)
+	}
+	return scan, nil
+}
+
+// scanSource scans a source file compiled into the package, if it exists.
+func scanSource(source string, rules []secretRule) []SecretFinding {
+	f, err := os.Open(filepath.FromSlash(source))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	findings, _, err := scanContent(io.LimitReader(f, maxScannedSize), rules, nil)
+	if err != nil {
+		logger.WithError(err).Warnf("Unable to scan %s for secrets", source)
+		return nil
+	}
+	for i := range findings {
+		findings[i].Source = source
+	}
+	return findings
+}
+
+// scanContent returns the secrets in the lines of a text file, whether it
+// holds compiled code and adds the source files of that code to sources.
+// Binary files are skipped.
+func scanContent(reader io.Reader, rules []secretRule, sources map[string]bool) ([]SecretFinding, bool, error) {
+	buffered := bufio.NewReader(reader)
+	head, _ := buffered.Peek(8000)
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, false, nil
+	}
+
+	var findings []SecretFinding
+	compiled := false
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Bytes()
+		if match := disasmRegex.FindSubmatch(text); match != nil {
+			compiled = true
+			if sources != nil && !isGemPath(string(match[1])) {
+				sources[string(match[1])] = true
+			}
+		}
+		for _, rule := range rules {
+			if match := rule.re.Find(text); match != nil {
+				findings = append(findings, SecretFinding{Rule: rule.id, Description: rule.description, Line: line, Match: redactMatch(string(bytes.TrimSpace(match)))})
+			}
+		}
+	}
+	return findings, compiled, scanner.Err()
+}
+
+// redactMatch only keeps the start of a match, enough to find it back.
+func redactMatch(match string) string {
+	const keep = 6
+	if len(match) <= keep*2 {
+		return match[:len(match)/3] + "****"
+	}
+	return match[:keep] + "****"
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// location describes where a finding is.
+func (f SecretFinding) location() string {
+	name := f.Entry
+	if name == "" {
+		name = f.Source
+	}
+	if f.Line > 0 {
+		return fmt.Sprintf("%s:%d", name, f.Line)
+	}
+	return name
+}
+
+// maxLoggedSecrets is how many secrets are listed in the console, all of them
+// are in the report.
+const maxLoggedSecrets = 20
+
+func logSecretScan(scan *SecretScan) {
+	if len(scan.Findings) == 0 {
+		logger.Infof("No secrets found in package %s", scan.File)
+		return
+	}
+	logger.Warnf("Found %d possible secret(s) in package %s", len(scan.Findings), scan.File)
+	for i, finding := range scan.Findings {
+		if i == maxLoggedSecrets {
+			logger.Warnf("... and %d more, see the report for all of them", len(scan.Findings)-maxLoggedSecrets)
+			break
+		}
+		if finding.Match != "" {
+			logger.Warnf("    %s: %s (%s) %s", finding.location(), finding.Description, finding.Rule, finding.Match)
+		} else {
+			logger.Warnf("    %s: %s (%s)", finding.location(), finding.Description, finding.Rule)
+		}
+	}
+}
+
+// applySecretPolicy fails or strips the package according to policy when
+// secrets were found.
+func applySecretPolicy(scan *SecretScan, policy string) error {
+	if len(scan.Findings) == 0 {
+		return nil
+	}
+	switch policy {
+	case OnSecretFail:
+		return &SecretsFoundError{File: scan.File, Findings: len(scan.Findings)}
+	case OnSecretStrip:
+		return stripSecrets(scan)
+	}
+	return nil
+}
+
+// stripSecrets rewrites the package without the entries with secrets. Secrets
+// in compiled code or source files can not be stripped, those need to be
+// removed from the application.
+func stripSecrets(scan *SecretScan) error {
+	strip := map[string]bool{}
+	unstrippable := 0
+	for _, finding := range scan.Findings {
+		if finding.Entry == "" || finding.Compiled {
+			logger.Errorf("Unable to strip the secret in %s, it is compiled into the package, please remove it from the application", finding.location())
+			unstrippable++
+			continue
+		}
+		strip[finding.Entry] = true
+	}
+
+	if len(strip) > 0 {
+		if err := rewriteZip(scan.File, func(name string) bool { return !strip[name] }); err != nil {
+			return err
+		}
+		scan.Stripped = sortedKeys(strip)
+		for _, entry := range scan.Stripped {
+			logger.Infof("Stripped %s from package %s", entry, scan.File)
+		}
+	}
+	if unstrippable > 0 {
+		return &SecretsFoundError{File: scan.File, Findings: unstrippable, Reason: " that can not be stripped"}
+	}
+	return nil
+}
+
+// rewriteZip rewrites the zip file with only the entries keep returns true
+// for.
+func rewriteZip(file string, keep func(name string) bool) error {
+	reader, err := zip.OpenReader(file)
+	if err != nil {
+		logger.WithError(err).Errorf("Unable to open package %s as zip", file)
+		return fmt.Errorf("unable to open package %s as zip: %v", file, err)
+	}
+	defer reader.Close()
+
+	return writeFileAtomic(file, 0644, func(w io.Writer) error {
+		writer := zip.NewWriter(w)
+		writer.SetComment(reader.Comment)
+		for _, f := range reader.File {
+			if !keep(f.Name) {
+				continue
+			}
+			// Copy without recompressing
+			if err := writer.Copy(f); err != nil {
+				logger.WithError(err).Errorf("Unable to copy %s in package %s", f.Name, file)
+				return fmt.Errorf("unable to copy %s in package %s", f.Name, file)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			logger.WithError(err).Errorf("Unable to write package %s", file)
+			return fmt.Errorf("unable to write package %s", file)
+		}
+		return nil
+	})
+}
+
+// scanSecrets scans the package after veracode prepare, adds the result to
+// the report and applies opts.OnSecret.
+func scanSecrets(file string, opts Options, report *Report) error {
+	if opts.OnSecret == OnSecretOff {
+		return nil
+	}
+	scan, err := ScanPackage(file, opts.SecretPatterns)
+	if err != nil {
+		return err
+	}
+	report.Secrets = scan
+	logSecretScan(scan)
+	return applySecretPolicy(scan, opts.OnSecret)
+}
+
+// Scan prints the secrets in the package in args, as text or JSON, and
+// applies policy.
+func Scan(args []string, format string, policy string, patterns []string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("invalid format '%s', expected %s or %s", format, FormatText, FormatJSON)
+	}
+	if !isOneOf(policy, onSecretPolicies) || policy == OnSecretOff {
+		return fmt.Errorf("invalid policy '%s', expected %s, %s or %s", policy, OnSecretWarn, OnSecretFail, OnSecretStrip)
+	}
+
+	scan, err := ScanPackage(args[0], patterns)
+	if err != nil {
+		return err
+	}
+	policyErr := applySecretPolicy(scan, policy)
+
+	if format == FormatJSON {
+		if err := printJSON(scan); err != nil {
+			return err
+		}
+	} else {
+		printSecretScan(scan)
+	}
+	return policyErr
+}
+
+func printSecretScan(scan *SecretScan) {
+	w := os.Stdout
+	fmt.Fprintf(w, "Package: %s\n", scan.File)
+	for _, finding := range scan.Findings {
+		fmt.Fprintf(w, "    %-18s %s %s\n", finding.Rule, finding.location(), finding.Match)
+	}
+	for _, entry := range scan.Stripped {
+		fmt.Fprintf(w, "Stripped %s\n", entry)
+	}
+	fmt.Fprintf(w, "%d possible secret(s) found\n", len(scan.Findings))
+}
+
+func isOneOf(value string, values []string) bool {
+	for _, v := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package vcrbpkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Formats of signing keys and signatures.
+const (
+	// signatureEd25519 is a base64 ed25519 signature in a .sig file, for keys
+	// in PEM (openssl genpkey -algorithm ed25519).
+	signatureEd25519 = "ed25519"
+	// signatureMinisign is a minisign signature in a .minisig file, for keys
+	// made with minisign -G.
+	signatureMinisign = "minisign"
+)
+
+// signatureExtensions are the extensions of the signature files by format.
+var signatureExtensions = map[string]string{
+	signatureEd25519:  ".sig",
+	signatureMinisign: ".minisig",
+}
+
+// signingKey is a private key to sign manifests with.
+type signingKey struct {
+	format     string
+	privateKey ed25519.PrivateKey
+	// keyID of minisign keys.
+	keyID []byte
+}
+
+// verifyingKey is a public key to verify signatures with.
+type verifyingKey struct {
+	format    string
+	publicKey ed25519.PublicKey
+	keyID     []byte
+}
+
+// minisign key and signature algorithms.
+var (
+	minisignAlgEd       = []byte("Ed")
+	minisignAlgPrehash  = []byte("ED")
+	minisignKDFScrypt   = []byte("Sc")
+	minisignKDFNone     = []byte{0, 0}
+	minisignChecksumAlg = []byte("B2")
+)
+
+const minisignUntrustedComment = "untrusted comment: "
+const minisignTrustedComment = "trusted comment: "
+
+// loadSigningKey reads an ed25519 private key in PEM or a minisign secret key,
+// decrypting the latter with password if needed.
+func loadSigningKey(file string, password string) (*signingKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signing key %s: %v", file, err)
+	}
+
+	if block, _ := pem.Decode(content); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %s: %v", file, err)
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("invalid signing key %s: only ed25519 keys are supported", file)
+		}
+		return &signingKey{format: signatureEd25519, privateKey: privateKey}, nil
+	}
+
+	key, err := parseMinisignSecretKey(content, password)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %v", file, err)
+	}
+	return key, nil
+}
+
+// parseMinisignSecretKey parses a minisign secret key:
+// "Ed" kdf "B2" salt(32) opslimit(8) memlimit(8) then encrypted keyID(8)
+// secret key(64) checksum(32).
+func parseMinisignSecretKey(content []byte, password string) (*signingKey, error) {
+	decoded, err := minisignBase64Line(content)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != 158 || !bytes.Equal(decoded[:2], minisignAlgEd) || !bytes.Equal(decoded[4:6], minisignChecksumAlg) {
+		return nil, errors.New("not an ed25519 PEM or minisign secret key")
+	}
+	kdf := decoded[2:4]
+	salt := decoded[6:38]
+	opsLimit := binary.LittleEndian.Uint64(decoded[38:46])
+	memLimit := binary.LittleEndian.Uint64(decoded[46:54])
+	keynum := append([]byte{}, decoded[54:]...)
+
+	switch {
+	case bytes.Equal(kdf, minisignKDFScrypt):
+		if password == "" {
+			return nil, errors.New("the minisign key is encrypted, set sign_password")
+		}
+		n, r, p := scryptParams(opsLimit, memLimit)
+		stream, err := scrypt.Key([]byte(password), salt, n, r, p, len(keynum))
+		if err != nil {
+			return nil, err
+		}
+		for i := range keynum {
+			keynum[i] ^= stream[i]
+		}
+	case !bytes.Equal(kdf, minisignKDFNone):
+		return nil, fmt.Errorf("unsupported minisign key derivation %q", kdf)
+	}
+
+	keyID, secretKey, checksum := keynum[:8], keynum[8:72], keynum[72:]
+	expected := blake2b.Sum256(append(append(append([]byte{}, minisignAlgEd...), keyID...), secretKey...))
+	if !bytes.Equal(checksum, expected[:]) {
+		return nil, errors.New("wrong password for the minisign key")
+	}
+	return &signingKey{format: signatureMinisign, privateKey: ed25519.PrivateKey(secretKey), keyID: keyID}, nil
+}
+
+// scryptParams converts the libsodium opslimit and memlimit of minisign to
+// the scrypt N, r and p, like crypto_pwhash_scryptsalsa208sha256 does.
+func scryptParams(opsLimit uint64, memLimit uint64) (int, int, int) {
+	const r = 8
+	if opsLimit < 32768 {
+		opsLimit = 32768
+	}
+	var maxN uint64
+	if opsLimit < memLimit/32 {
+		maxN = opsLimit / (r * 4)
+		return 1 << scryptNLog2(maxN), r, 1
+	}
+	maxN = memLimit / (r * 128)
+	nLog2 := scryptNLog2(maxN)
+	maxRP := (opsLimit / 4) / (uint64(1) << nLog2)
+	if maxRP > 0x3fffffff {
+		maxRP = 0x3fffffff
+	}
+	return 1 << nLog2, r, int(maxRP / r)
+}
+
+// scryptNLog2 returns the smallest n from 1 where 2^n > max/2.
+func scryptNLog2(max uint64) uint {
+	nLog2 := uint(1)
+	for ; nLog2 < 63; nLog2++ {
+		if uint64(1)<<nLog2 > max/2 {
+			break
+		}
+	}
+	return nLog2
+}
+
+// minisignBase64Line decodes the first line that is not a comment.
+func minisignBase64Line(content []byte) ([]byte, error) {
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, minisignUntrustedComment) || strings.HasPrefix(line, minisignTrustedComment) {
+			continue
+		}
+		return base64.StdEncoding.DecodeString(line)
+	}
+	return nil, errors.New("no key found")
+}
+
+// sign returns the signature of message in the format of the key, name is
+// recorded in the trusted comment of minisign signatures.
+func (k *signingKey) sign(message []byte, name string) []byte {
+	if k.format == signatureEd25519 {
+		return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(k.privateKey, message)) + "\n")
+	}
+
+	hash := blake2b.Sum512(message)
+	signature := ed25519.Sign(k.privateKey, hash[:])
+	trustedComment := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), name)
+	globalSignature := ed25519.Sign(k.privateKey, append(append([]byte{}, signature...), trustedComment...))
+
+	var b strings.Builder
+	b.WriteString(minisignUntrustedComment + "signature from vcrbpkg\n")
+	b.WriteString(base64.StdEncoding.EncodeToString(append(append(append([]byte{}, minisignAlgPrehash...), k.keyID...), signature...)) + "\n")
+	b.WriteString(minisignTrustedComment + trustedComment + "\n")
+	b.WriteString(base64.StdEncoding.EncodeToString(globalSignature) + "\n")
+	return []byte(b.String())
+}
+
+// loadVerifyingKey reads an ed25519 public key in PEM or a minisign public key,
+// as file or the base64 key itself.
+func loadVerifyingKey(fileOrKey string) (*verifyingKey, error) {
+	content, err := os.ReadFile(fileOrKey)
+	if err != nil {
+		if !strings.HasPrefix(fileOrKey, "RW") {
+			return nil, fmt.Errorf("unable to read public key %s: %v", fileOrKey, err)
+		}
+		content = []byte(fileOrKey)
+	}
+
+	if block, _ := pem.Decode(content); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %s: %v", fileOrKey, err)
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("invalid public key %s: only ed25519 keys are supported", fileOrKey)
+		}
+		return &verifyingKey{format: signatureEd25519, publicKey: publicKey}, nil
+	}
+
+	decoded, err := minisignBase64Line(content)
+	if err != nil || len(decoded) != 42 || !bytes.Equal(decoded[:2], minisignAlgEd) {
+		return nil, fmt.Errorf("invalid public key %s: not an ed25519 PEM or minisign public key", fileOrKey)
+	}
+	return &verifyingKey{format: signatureMinisign, keyID: decoded[2:10], publicKey: ed25519.PublicKey(decoded[10:])}, nil
+}
+
+// verify checks the signature of message.
+func (k *verifyingKey) verify(message []byte, signature []byte) error {
+	if k.format == signatureEd25519 {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil {
+			return fmt.Errorf("invalid signature: %v", err)
+		}
+		if !ed25519.Verify(k.publicKey, message, decoded) {
+			return errors.New("signature does not match")
+		}
+		return nil
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(signature), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], minisignTrustedComment) {
+		return errors.New("invalid minisign signature")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(decoded) != 74 {
+		return errors.New("invalid minisign signature")
+	}
+	algorithm, keyID, sig := decoded[:2], decoded[2:10], decoded[10:]
+	if !bytes.Equal(keyID, k.keyID) {
+		return fmt.Errorf("signed with key %X, not %X", reverse(keyID), reverse(k.keyID))
+	}
+
+	signed := message
+	switch {
+	case bytes.Equal(algorithm, minisignAlgPrehash):
+		hash := blake2b.Sum512(message)
+		signed = hash[:]
+	case !bytes.Equal(algorithm, minisignAlgEd):
+		return fmt.Errorf("unsupported minisign signature algorithm %q", algorithm)
+	}
+	if !ed25519.Verify(k.publicKey, signed, sig) {
+		return errors.New("signature does not match")
+	}
+
+	globalSignature, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil {
+		return errors.New("invalid minisign signature")
+	}
+	trustedComment := strings.TrimPrefix(lines[2], minisignTrustedComment)
+	if !ed25519.Verify(k.publicKey, append(append([]byte{}, sig...), trustedComment...), globalSignature) {
+		return errors.New("trusted comment signature does not match")
+	}
+	return nil
+}
+
+// reverse returns the bytes in reverse order, minisign shows key IDs as
+// little endian numbers.
+func reverse(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	for i := range b {
+		reversed[len(b)-1-i] = b[i]
+	}
+	return reversed
+}
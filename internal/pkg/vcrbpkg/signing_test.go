@@ -0,0 +1,276 @@
+package vcrbpkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestScryptParams(t *testing.T) {
+	// Expected values from pickparams in libsodium's
+	// crypto_pwhash/scryptsalsa208sha256/pwhash_scryptsalsa208sha256.c
+	tests := []struct {
+		name     string
+		opsLimit uint64
+		memLimit uint64
+		n, r, p  int
+	}{
+		{"sensitive, minisign -G", 33554432, 1073741824, 1 << 20, 8, 1},
+		{"interactive", 524288, 16777216, 1 << 14, 8, 1},
+		{"opslimit below memlimit", 1048576, 1073741824, 1 << 15, 8, 1},
+		{"opslimit raised to the minimum", 1, 1073741824, 1 << 10, 8, 1},
+		{"p from opslimit", 1073741824, 16777216, 1 << 14, 8, 2048},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, r, p := scryptParams(test.opsLimit, test.memLimit)
+			if n != test.n || r != test.r || p != test.p {
+				t.Errorf("scryptParams(%d, %d) = %d, %d, %d, want %d, %d, %d", test.opsLimit, test.memLimit, n, r, p, test.n, test.r, test.p)
+			}
+		})
+	}
+}
+
+// minisignKeyPair writes a secret and public key in the format of minisign -G
+// to dir, encrypted with password unless it is empty. The scrypt limits are
+// the libsodium interactive ones to keep the test fast, minisign uses the
+// sensitive ones.
+func minisignKeyPair(t *testing.T, dir string, password string) (string, string) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 40)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	keyID, salt := random[:8], random[8:]
+
+	checksum := blake2b.Sum256(append(append(append([]byte{}, minisignAlgEd...), keyID...), privateKey...))
+	keynum := append(append(append([]byte{}, keyID...), privateKey...), checksum[:]...)
+	kdf := minisignKDFNone
+	opsLimit, memLimit := uint64(524288), uint64(16777216)
+	if password != "" {
+		kdf = minisignKDFScrypt
+		n, r, p := scryptParams(opsLimit, memLimit)
+		stream, err := scrypt.Key([]byte(password), salt, n, r, p, len(keynum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range keynum {
+			keynum[i] ^= stream[i]
+		}
+	}
+
+	limits := make([]byte, 16)
+	binary.LittleEndian.PutUint64(limits, opsLimit)
+	binary.LittleEndian.PutUint64(limits[8:], memLimit)
+	secret := append(append(append(append(append([]byte{}, minisignAlgEd...), kdf...), minisignChecksumAlg...), salt...), limits...)
+	secret = append(secret, keynum...)
+	public := append(append(append([]byte{}, minisignAlgEd...), keyID...), publicKey...)
+
+	secretFile := filepath.Join(dir, "minisign.key")
+	publicFile := filepath.Join(dir, "minisign.pub")
+	writeTestFile(t, secretFile, "untrusted comment: minisign encrypted secret key\n"+base64.StdEncoding.EncodeToString(secret)+"\n")
+	writeTestFile(t, publicFile, fmt.Sprintf("untrusted comment: minisign public key %X\n%s\n", reverse(keyID), base64.StdEncoding.EncodeToString(public)))
+	return secretFile, publicFile
+}
+
+// ed25519KeyPair writes a private and public key in PEM like openssl genpkey
+// -algorithm ed25519 and openssl pkey -pubout to dir.
+func ed25519KeyPair(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateFile := filepath.Join(dir, "vcrbpkg.pem")
+	publicFile := filepath.Join(dir, "vcrbpkg.pub.pem")
+	writeTestFile(t, privateFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private})))
+	writeTestFile(t, publicFile, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})))
+	return privateFile, publicFile
+}
+
+func writeTestFile(t *testing.T, file string, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	dir := t.TempDir()
+	message := []byte(`{"package": "railsgoat.zip"}` + "\n")
+
+	tests := []struct {
+		name     string
+		keyPair  func() (string, string)
+		password string
+	}{
+		{"minisign encrypted", func() (string, string) { return minisignKeyPair(t, t.TempDir(), "correct horse") }, "correct horse"},
+		{"minisign unencrypted", func() (string, string) { return minisignKeyPair(t, t.TempDir(), "") }, ""},
+		{"ed25519 PEM", func() (string, string) { return ed25519KeyPair(t, dir) }, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secretFile, publicFile := test.keyPair()
+			signer, err := loadSigningKey(secretFile, test.password)
+			if err != nil {
+				t.Fatalf("loadSigningKey: %v", err)
+			}
+			verifier, err := loadVerifyingKey(publicFile)
+			if err != nil {
+				t.Fatalf("loadVerifyingKey: %v", err)
+			}
+			if signer.format != verifier.format {
+				t.Fatalf("signing key format %s, verifying key format %s", signer.format, verifier.format)
+			}
+
+			signature := signer.sign(message, "railsgoat.manifest.json")
+			if err := verifier.verify(message, signature); err != nil {
+				t.Errorf("verify: %v", err)
+			}
+			if err := verifier.verify(append([]byte("x"), message...), signature); err == nil {
+				t.Error("verify of a changed message succeeded")
+			}
+		})
+	}
+}
+
+func TestVerifyMinisignPublicKeyString(t *testing.T) {
+	secretFile, publicFile := minisignKeyPair(t, t.TempDir(), "")
+	content, err := os.ReadFile(publicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+
+	signer, err := loadSigningKey(secretFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := loadVerifyingKey(lines[1])
+	if err != nil {
+		t.Fatalf("loadVerifyingKey(%s): %v", lines[1], err)
+	}
+	message := []byte("manifest")
+	if err := verifier.verify(message, signer.sign(message, "manifest.json")); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+}
+
+func TestLoadMinisignSecretKeyErrors(t *testing.T) {
+	secretFile, _ := minisignKeyPair(t, t.TempDir(), "correct horse")
+
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{"no password", "", "the minisign key is encrypted"},
+		{"wrong password", "battery staple", "wrong password"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadSigningKey(secretFile, test.password)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("loadSigningKey = %v, want error with %q", err, test.want)
+			}
+		})
+	}
+
+	notAKey := filepath.Join(t.TempDir(), "not.key")
+	writeTestFile(t, notAKey, "untrusted comment: nothing\n"+base64.StdEncoding.EncodeToString([]byte("Ed"))+"\n")
+	if _, err := loadSigningKey(notAKey, ""); err == nil {
+		t.Error("loadSigningKey of a truncated key succeeded")
+	}
+}
+
+func TestVerifyMinisignFailures(t *testing.T) {
+	dir := t.TempDir()
+	secretFile, publicFile := minisignKeyPair(t, dir, "")
+	_, otherPublicFile := minisignKeyPair(t, t.TempDir(), "")
+
+	signer, err := loadSigningKey(secretFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := loadVerifyingKey(publicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVerifier, err := loadVerifyingKey(otherPublicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same key ID with another public key
+	impostor := &verifyingKey{format: signatureMinisign, keyID: verifier.keyID, publicKey: otherVerifier.publicKey}
+
+	message := []byte("manifest")
+	signature := string(signer.sign(message, "manifest.json"))
+	lines := strings.Split(strings.TrimSpace(signature), "\n")
+
+	tests := []struct {
+		name      string
+		verifier  *verifyingKey
+		signature string
+		want      string
+	}{
+		{"other key", otherVerifier, signature, "signed with key"},
+		{"other public key with the same key ID", impostor, signature, "signature does not match"},
+		{"changed trusted comment", verifier, strings.Join([]string{lines[0], lines[1], lines[2] + "\tforged", lines[3]}, "\n"), "trusted comment signature does not match"},
+		{"missing global signature", verifier, strings.Join(lines[:3], "\n"), "invalid minisign signature"},
+		{"invalid signature", verifier, strings.Join([]string{lines[0], "bm90IGEgc2lnbmF0dXJl", lines[2], lines[3]}, "\n"), "invalid minisign signature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.verifier.verify(message, []byte(test.signature))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("verify = %v, want error with %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyEd25519Failures(t *testing.T) {
+	dir := t.TempDir()
+	privateFile, _ := ed25519KeyPair(t, dir)
+	_, otherPublicFile := ed25519KeyPair(t, t.TempDir())
+
+	signer, err := loadSigningKey(privateFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVerifier, err := loadVerifyingKey(otherPublicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte("manifest")
+	if err := otherVerifier.verify(message, signer.sign(message, "manifest.json")); err == nil {
+		t.Error("verify with another key succeeded")
+	}
+	if err := otherVerifier.verify(message, []byte("not base64!\n")); err == nil {
+		t.Error("verify of an invalid signature succeeded")
+	}
+}
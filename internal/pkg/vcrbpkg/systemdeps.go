@@ -0,0 +1,382 @@
+package vcrbpkg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// Distribution families we know the package names for.
+const (
+	distroDebian = "debian"
+	distroRHEL   = "rhel"
+	distroAlpine = "alpine"
+)
+
+var distroNames = map[string]string{
+	distroDebian: "Debian/Ubuntu",
+	distroRHEL:   "RHEL/Fedora",
+	distroAlpine: "Alpine",
+}
+
+// systemLibrary is a native library that needs its development headers
+// installed to build Ruby or a gem with a C extension.
+type systemLibrary struct {
+	Name string
+	// Headers to look for, any of them being present is enough.
+	Headers []string
+	// PkgConfig module name, if the library ships one.
+	PkgConfig string
+	// Packages providing the headers per distribution family.
+	Packages map[string]string
+}
+
+var (
+	libYAML = systemLibrary{
+		Name:      "libyaml",
+		Headers:   []string{"yaml.h"},
+		PkgConfig: "yaml-0.1",
+		Packages:  map[string]string{distroDebian: "libyaml-dev", distroRHEL: "libyaml-devel", distroAlpine: "yaml-dev"},
+	}
+	libFFI = systemLibrary{
+		Name:      "libffi",
+		Headers:   []string{"ffi.h"},
+		PkgConfig: "libffi",
+		Packages:  map[string]string{distroDebian: "libffi-dev", distroRHEL: "libffi-devel", distroAlpine: "libffi-dev"},
+	}
+	zlib = systemLibrary{
+		Name:      "zlib",
+		Headers:   []string{"zlib.h"},
+		PkgConfig: "zlib",
+		Packages:  map[string]string{distroDebian: "zlib1g-dev", distroRHEL: "zlib-devel", distroAlpine: "zlib-dev"},
+	}
+	openSSL = systemLibrary{
+		Name:      "OpenSSL",
+		Headers:   []string{"openssl/ssl.h"},
+		PkgConfig: "openssl",
+		Packages:  map[string]string{distroDebian: "libssl-dev", distroRHEL: "openssl-devel", distroAlpine: "openssl-dev"},
+	}
+	libPQ = systemLibrary{
+		Name:      "libpq",
+		Headers:   []string{"libpq-fe.h", "postgresql/libpq-fe.h"},
+		PkgConfig: "libpq",
+		Packages:  map[string]string{distroDebian: "libpq-dev", distroRHEL: "libpq-devel", distroAlpine: "postgresql-dev"},
+	}
+	libMySQLClient = systemLibrary{
+		Name:      "libmysqlclient",
+		Headers:   []string{"mysql/mysql.h", "mariadb/mysql.h", "mysql.h"},
+		PkgConfig: "mysqlclient",
+		Packages:  map[string]string{distroDebian: "default-libmysqlclient-dev", distroRHEL: "mariadb-connector-c-devel", distroAlpine: "mariadb-dev"},
+	}
+	libXML2 = systemLibrary{
+		Name:      "libxml2",
+		Headers:   []string{"libxml2/libxml/parser.h", "libxml/parser.h"},
+		PkgConfig: "libxml-2.0",
+		Packages:  map[string]string{distroDebian: "libxml2-dev", distroRHEL: "libxml2-devel", distroAlpine: "libxml2-dev"},
+	}
+	libXSLT = systemLibrary{
+		Name:      "libxslt",
+		Headers:   []string{"libxslt/xslt.h"},
+		PkgConfig: "libxslt",
+		Packages:  map[string]string{distroDebian: "libxslt1-dev", distroRHEL: "libxslt-devel", distroAlpine: "libxslt-dev"},
+	}
+	imageMagick = systemLibrary{
+		Name:      "ImageMagick",
+		Headers:   []string{"ImageMagick-6/wand/MagickWand.h", "ImageMagick-7/MagickWand/MagickWand.h", "wand/MagickWand.h", "MagickWand/MagickWand.h"},
+		PkgConfig: "MagickWand",
+		Packages:  map[string]string{distroDebian: "libmagickwand-dev", distroRHEL: "ImageMagick-devel", distroAlpine: "imagemagick-dev"},
+	}
+	openLDAP = systemLibrary{
+		Name:      "OpenLDAP",
+		Headers:   []string{"ldap.h"},
+		PkgConfig: "ldap",
+		Packages:  map[string]string{distroDebian: "libldap2-dev", distroRHEL: "openldap-devel", distroAlpine: "openldap-dev"},
+	}
+	libIDN = systemLibrary{
+		Name:      "libidn",
+		Headers:   []string{"idna.h"},
+		PkgConfig: "libidn",
+		Packages:  map[string]string{distroDebian: "libidn11-dev", distroRHEL: "libidn-devel", distroAlpine: "libidn-dev"},
+	}
+	sqlite3 = systemLibrary{
+		Name:      "SQLite",
+		Headers:   []string{"sqlite3.h"},
+		PkgConfig: "sqlite3",
+		Packages:  map[string]string{distroDebian: "libsqlite3-dev", distroRHEL: "sqlite-devel", distroAlpine: "sqlite-dev"},
+	}
+	libCurl = systemLibrary{
+		Name:      "libcurl",
+		Headers:   []string{"curl/curl.h"},
+		PkgConfig: "libcurl",
+		Packages:  map[string]string{distroDebian: "libcurl4-openssl-dev", distroRHEL: "libcurl-devel", distroAlpine: "curl-dev"},
+	}
+	icu = systemLibrary{
+		Name:      "ICU",
+		Headers:   []string{"unicode/ucnv.h"},
+		PkgConfig: "icu-uc",
+		Packages:  map[string]string{distroDebian: "libicu-dev", distroRHEL: "libicu-devel", distroAlpine: "icu-dev"},
+	}
+)
+
+// rubyBuildLibraries are needed to compile Ruby itself with RVM.
+var rubyBuildLibraries = []systemLibrary{libYAML, libFFI, zlib, openSSL}
+
+// gemLibrary maps a gem with a C extension to the native library it needs.
+type gemLibrary struct {
+	Gem     string
+	Library systemLibrary
+	// Optional when the gem can also use a vendored copy of the library.
+	Optional bool
+}
+
+var gemLibraries = []gemLibrary{
+	{Gem: "pg", Library: libPQ},
+	{Gem: "mysql2", Library: libMySQLClient},
+	{Gem: "nokogiri", Library: libXML2, Optional: true},
+	{Gem: "nokogiri", Library: libXSLT, Optional: true},
+	{Gem: "libxml-ruby", Library: libXML2},
+	{Gem: "rmagick", Library: imageMagick},
+	{Gem: "ruby-ldap", Library: openLDAP},
+	{Gem: "ldap", Library: openLDAP},
+	{Gem: "idn-ruby", Library: libIDN},
+	{Gem: "sqlite3", Library: sqlite3, Optional: true},
+	{Gem: "curb", Library: libCurl},
+	{Gem: "charlock_holmes", Library: icu},
+	{Gem: "psych", Library: libYAML},
+	{Gem: "ffi", Library: libFFI, Optional: true},
+}
+
+// requiredGemLibraries returns the native libraries needed by the locked gems.
+func requiredGemLibraries(lockfile *Lockfile) []gemLibrary {
+	var required []gemLibrary
+	for _, gemLibrary := range gemLibraries {
+		if lockfile.HasGem(gemLibrary.Gem) {
+			required = append(required, gemLibrary)
+		}
+	}
+	return required
+}
+
+// systemTool is a binary needed to build Ruby or native gems.
+type systemTool struct {
+	Name string
+	// Binaries to look for, any of them being present is enough.
+	Binaries []string
+	Packages map[string]string
+}
+
+var buildTools = []systemTool{
+	{
+		Name:     "C compiler",
+		Binaries: []string{"cc", "gcc", "clang"},
+		Packages: map[string]string{distroDebian: "build-essential", distroRHEL: "gcc", distroAlpine: "build-base"},
+	},
+	{
+		Name:     "C++ compiler",
+		Binaries: []string{"c++", "g++", "clang++"},
+		Packages: map[string]string{distroDebian: "build-essential", distroRHEL: "gcc-c++", distroAlpine: "build-base"},
+	},
+	{
+		Name:     "make",
+		Binaries: []string{"make"},
+		Packages: map[string]string{distroDebian: "make", distroRHEL: "make", distroAlpine: "make"},
+	},
+}
+
+// find returns the path of the first available binary of the tool.
+func (t systemTool) find() (string, bool) {
+	for _, binary := range t.Binaries {
+		if path, err := exec.LookPath(binary); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// find returns where the library was found, through pkg-config or by looking
+// for its headers in the usual include directories.
+func (l systemLibrary) find() (string, bool) {
+	if l.PkgConfig != "" {
+		if _, err := exec.LookPath("pkg-config"); err == nil {
+			if exec.Command("pkg-config", "--exists", l.PkgConfig).Run() == nil {
+				return "pkg-config " + l.PkgConfig, true
+			}
+		}
+	}
+
+	for _, includeDir := range includeDirs() {
+		for _, header := range l.Headers {
+			path := filepath.Join(includeDir, header)
+			if _, err := os.Stat(path); err == nil {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+func includeDirs() []string {
+	dirs := []string{"/usr/include", "/usr/local/include", "/opt/homebrew/include"}
+	multiarchDirs, _ := filepath.Glob("/usr/include/*-linux-*")
+	return append(dirs, multiarchDirs...)
+}
+
+// detectDistro returns the distribution family of the running system based on
+// /etc/os-release, or an empty string if it is unknown.
+func detectDistro() string {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found || (key != "ID" && key != "ID_LIKE") {
+			continue
+		}
+		ids = append(ids, strings.Fields(strings.Trim(value, `"'`))...)
+	}
+
+	for _, id := range ids {
+		switch id {
+		case "debian", "ubuntu":
+			return distroDebian
+		case "rhel", "fedora", "centos", "rocky", "almalinux":
+			return distroRHEL
+		case "alpine":
+			return distroAlpine
+		}
+	}
+	return ""
+}
+
+// uniquePackages returns the sorted, deduplicated package names for distro.
+func uniquePackages(distro string, packages ...map[string]string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, p := range packages {
+		name, found := p[distro]
+		if !found || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packageManager installs distribution packages.
+type packageManager struct {
+	Distro  string
+	Binary  string
+	Update  []string
+	Install []string
+}
+
+var packageManagers = []packageManager{
+	{Distro: distroDebian, Binary: "apt-get", Update: []string{"apt-get", "update"}, Install: []string{"apt-get", "install", "-y", "--no-install-recommends"}},
+	{Distro: distroRHEL, Binary: "dnf", Install: []string{"dnf", "install", "-y"}},
+	{Distro: distroRHEL, Binary: "yum", Install: []string{"yum", "install", "-y"}},
+	{Distro: distroAlpine, Binary: "apk", Install: []string{"apk", "add", "--no-cache"}},
+}
+
+// detectPackageManager returns the first known package manager on the PATH.
+func detectPackageManager() (packageManager, bool) {
+	for _, pm := range packageManagers {
+		if _, err := exec.LookPath(pm.Binary); err == nil {
+			return pm, true
+		}
+	}
+	return packageManager{}, false
+}
+
+func installCommand(distro string, packages []string) string {
+	for _, pm := range packageManagers {
+		if pm.Distro == distro {
+			return strings.Join(append(pm.Install, packages...), " ")
+		}
+	}
+	return ""
+}
+
+// installSystemDeps installs the missing native libraries needed by the gems
+// in the Gemfile.lock with the package manager of the system. With dryRun it
+// only logs what would be installed.
+func installSystemDeps(ctx context.Context, repoFolder string, dryRun bool) error {
+	lockfile, err := parseLockfile(repoFolder)
+	if err != nil {
+		logger.Warn("No Gemfile.lock, unable to determine system dependencies of gems, skipping install")
+		return nil
+	}
+
+	var missing []map[string]string
+	for _, gemLibrary := range requiredGemLibraries(lockfile) {
+		if location, found := gemLibrary.Library.find(); found {
+			logger.Infof("%s needed by %s found at %s", gemLibrary.Library.Name, gemLibrary.Gem, location)
+			continue
+		}
+		if gemLibrary.Optional {
+			logger.Infof("%s needed by %s not found, but %s can use its own copy, not installing", gemLibrary.Library.Name, gemLibrary.Gem, gemLibrary.Gem)
+			continue
+		}
+		logger.Infof("%s needed by %s not found", gemLibrary.Library.Name, gemLibrary.Gem)
+		missing = append(missing, gemLibrary.Library.Packages)
+	}
+
+	if len(missing) == 0 {
+		logger.Info("All system dependencies of gems are installed")
+		return nil
+	}
+
+	pm, found := detectPackageManager()
+	if !found {
+		logger.Error("No supported package manager (apt-get, dnf, yum, apk) found")
+		return fmt.Errorf("unable to install system dependencies, no supported package manager (apt-get, dnf, yum, apk) found")
+	}
+
+	packages := uniquePackages(pm.Distro, missing...)
+	commands := [][]string{append(pm.Install, packages...)}
+	if pm.Update != nil {
+		commands = append([][]string{pm.Update}, commands...)
+	}
+
+	if dryRun {
+		for _, command := range commands {
+			logger.Infof("Would run: %s", strings.Join(command, " "))
+		}
+		return nil
+	}
+
+	if os.Geteuid() != 0 {
+		if exec.Command("sudo", "-n", "true").Run() != nil {
+			logger.Errorf("Refusing to install system packages %s: not running as root and passwordless sudo is not available", strings.Join(packages, " "))
+			return fmt.Errorf("installing system dependencies requires root, run vcrbpkg as root or install them yourself with: %s", strings.Join(commands[len(commands)-1], " "))
+		}
+		for i, command := range commands {
+			commands[i] = append([]string{"sudo", "-n"}, command...)
+		}
+	}
+
+	for _, command := range commands {
+		logger.Infof("Running %s", strings.Join(command, " "))
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout = commandOutput
+		cmd.Stderr = os.Stderr
+		if err := runCommand(ctx, cmd); err != nil {
+			logger.WithError(err).Errorf("failed to run %s", strings.Join(command, " "))
+			return fmt.Errorf("failed to install system dependencies with %s", pm.Binary)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package vcrbpkg
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/relaxnow/vcrbpkg/internal/pkg/logger"
+)
+
+// ExitInvalidPackage is the exit code when the package fails validation.
+const ExitInvalidPackage = 5
+
+// DefaultMaxPackageSize is the largest file Veracode accepts for upload.
+const DefaultMaxPackageSize = ByteSize(5 << 30)
+
+// Validation policies, what to do with the issues found in the package.
+const (
+	// ValidateOff skips validation.
+	ValidateOff = "off"
+	// ValidateWarn only logs the issues.
+	ValidateWarn = "warn"
+	// ValidateFail fails on errors and logs warnings.
+	ValidateFail = "fail"
+	// ValidateStrict fails on errors and warnings.
+	ValidateStrict = "strict"
+)
+
+var validatePolicies = []string{ValidateOff, ValidateWarn, ValidateFail, ValidateStrict}
+
+// Severities of validation issues.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Validation checks of a package.
+const (
+	checkZip       = "zip"
+	checkEmpty     = "empty"
+	checkTruncated = "truncated"
+	checkCompiled  = "compiled"
+	checkMetadata  = "metadata"
+	checkSize      = "size"
+	checkJunk      = "junk"
+)
+
+// Validation is the result of validating a package.
+type Validation struct {
+	File   string            `json:"file"`
+	Issues []ValidationIssue `json:"issues"`
+}
+
+// ValidationIssue is a problem found in a package.
+type ValidationIssue struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Entry    string `json:"entry,omitempty"`
+}
+
+func (v *Validation) add(check string, severity string, entry string, format string, args ...interface{}) {
+	v.Issues = append(v.Issues, ValidationIssue{Check: check, Severity: severity, Entry: entry, Message: fmt.Sprintf(format, args...)})
+}
+
+// count returns the number of issues with severity.
+func (v *Validation) count(severity string) int {
+	count := 0
+	for _, issue := range v.Issues {
+		if issue.Severity == severity {
+			count++
+		}
+	}
+	return count
+}
+
+// failed returns whether the issues fail validation with policy.
+func (v *Validation) failed(policy string) bool {
+	switch policy {
+	case ValidateFail:
+		return v.count(severityError) > 0
+	case ValidateStrict:
+		return len(v.Issues) > 0
+	}
+	return false
+}
+
+// ValidationError is returned when a package fails validation.
+type ValidationError struct {
+	File     string
+	Errors   int
+	Warnings int
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("package %s is invalid: %d error(s), %d warning(s)", e.File, e.Errors, e.Warnings)
+}
+
+// ExitCode makes vcrbpkg exit with ExitInvalidPackage.
+func (e *ValidationError) ExitCode() int {
+	return ExitInvalidPackage
+}
+
+// ValidatePackage checks the package at file opens, is complete, has
+// compiled code and metadata, is not too large to upload and has no files
+// that do not belong in a package.
+func ValidatePackage(file string, maxSize ByteSize) *Validation {
+	validation := &Validation{File: file, Issues: []ValidationIssue{}}
+
+	reader, err := zip.OpenReader(file)
+	if err != nil {
+		validation.add(checkZip, severityError, "", "unable to open the package as zip: %v", err)
+		return validation
+	}
+	entries, err := readEntries(&reader.Reader)
+	reader.Close()
+	if err != nil {
+		validation.add(checkTruncated, severityError, "", "%v", err)
+		return validation
+	}
+	if entries == 0 {
+		validation.add(checkEmpty, severityError, "", "the package has no files")
+		return validation
+	}
+
+	info, err := InspectPackage(file)
+	if err != nil {
+		validation.add(checkZip, severityError, "", "%v", err)
+		return validation
+	}
+	if info.InstructionSequences == 0 {
+		validation.add(checkCompiled, severityError, "", "no compiled instruction sequences found, Veracode will not see any code")
+	}
+	if len(info.Metadata.Files) == 0 {
+		validation.add(checkMetadata, severityError, "", "no Ruby, Rails or veracode gem version found in the package")
+	}
+	if maxSize > 0 && uint64(info.Size) > uint64(maxSize) {
+		validation.add(checkSize, severityError, "", "the package is %s, more than the upload limit of %s",
+			humanSize(uint64(info.Size)), humanSize(uint64(maxSize)))
+	}
+	for _, entry := range info.Unexpected {
+		validation.add(checkJunk, severityWarning, entry.Name, "%s should not be in the package", entry.Reason)
+	}
+	return validation
+}
+
+// readEntries reads every entry of the package, which fails on checksums
+// and sizes that do not match, like in a truncated download or copy. It
+// returns the number of files.
+func readEntries(reader *zip.Reader) (int, error) {
+	entries := 0
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entries++
+		entry, err := f.Open()
+		if err != nil {
+			return entries, fmt.Errorf("unable to read %s: %v", f.Name, err)
+		}
+		_, err = io.Copy(io.Discard, entry)
+		entry.Close()
+		if err != nil {
+			return entries, fmt.Errorf("unable to read %s: %v", f.Name, err)
+		}
+	}
+	return entries, nil
+}
+
+// logValidation logs the issues of a validation.
+func logValidation(validation *Validation) {
+	for _, issue := range validation.Issues {
+		message := issue.Message
+		if issue.Entry != "" {
+			message = issue.Entry + ": " + message
+		}
+		if issue.Severity == severityError {
+			logger.Errorf("Package validation (%s): %s", issue.Check, message)
+		} else {
+			logger.Warnf("Package validation (%s): %s", issue.Check, message)
+		}
+	}
+	if len(validation.Issues) == 0 {
+		logger.Infof("Package %s is valid", validation.File)
+	}
+}
+
+// validatePackage validates the package after veracode prepare, adds the
+// result to the report and fails according to opts.Validate.
+func validatePackage(file string, opts Options, report *Report) error {
+	if opts.Validate == ValidateOff {
+		return nil
+	}
+	validation := ValidatePackage(file, opts.MaxPackageSize)
+	report.Validation = validation
+	logValidation(validation)
+
+	if validation.failed(opts.Validate) {
+		return &ValidationError{File: file, Errors: validation.count(severityError), Warnings: validation.count(severityWarning)}
+	}
+	return nil
+}
+
+// Validate prints the validation of the package in args, as text or JSON. A
+// *ValidationError is returned for errors, or also warnings when strict.
+func Validate(args []string, format string, maxSize ByteSize, strict bool) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("invalid format '%s', expected %s or %s", format, FormatText, FormatJSON)
+	}
+
+	validation := ValidatePackage(args[0], maxSize)
+	if format == FormatJSON {
+		if err := printJSON(validation); err != nil {
+			return err
+		}
+	} else {
+		printValidation(validation)
+	}
+
+	policy := ValidateFail
+	if strict {
+		policy = ValidateStrict
+	}
+	if validation.failed(policy) {
+		return &ValidationError{File: validation.File, Errors: validation.count(severityError), Warnings: validation.count(severityWarning)}
+	}
+	return nil
+}
+
+func printValidation(validation *Validation) {
+	w := os.Stdout
+	fmt.Fprintf(w, "Package: %s\n", validation.File)
+	for _, issue := range validation.Issues {
+		if issue.Entry != "" {
+			fmt.Fprintf(w, "    %-7s %-9s %s: %s\n", issue.Severity, issue.Check, issue.Entry, issue.Message)
+		} else {
+			fmt.Fprintf(w, "    %-7s %-9s %s\n", issue.Severity, issue.Check, issue.Message)
+		}
+	}
+	fmt.Fprintf(w, "%d error(s), %d warning(s)\n", validation.count(severityError), validation.count(severityWarning))
+}